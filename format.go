@@ -0,0 +1,72 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jackbister/csql/pkg/csql"
+)
+
+// runFmt runs the fmt subcommand, which prints a query in canonical form.
+// The query is read from a file given with -f, the command line or stdin.
+func runFmt(args []string) error {
+	flags := flag.NewFlagSet("csql fmt", flag.ExitOnError)
+	explicit := flags.Bool("explicit", false, "Write out implicit column references")
+	queryFile := flags.String("f", "", "Read the query from this file instead of the command line")
+	write := flags.Bool("w", false, "Write the formatted query back to the file given with -f")
+	flags.Parse(args)
+
+	var queryString string
+	if *queryFile != "" {
+		b, err := os.ReadFile(*queryFile)
+		if err != nil {
+			return err
+		}
+		queryString = string(b)
+	} else if flags.NArg() > 0 {
+		queryString = flags.Arg(0)
+	} else {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		queryString = string(b)
+	}
+	if *write && *queryFile == "" {
+		return fmt.Errorf("-w requires a file given with -f")
+	}
+
+	formatted, err := csql.Format(queryString, *explicit)
+	var diagnostic *csql.Diagnostic
+	if errors.As(err, &diagnostic) {
+		fmt.Fprintln(os.Stderr, diagnostic.Highlight(queryString))
+		os.Exit(1)
+	}
+	if err != nil {
+		return err
+	}
+	if *write {
+		return os.WriteFile(*queryFile, []byte(formatted), 0644)
+	}
+	_, err = fmt.Print(formatted)
+	return err
+}
@@ -2,4 +2,9 @@ module github.com/jackbister/csql
 
 go 1.21.1
 
-require github.com/araddon/dateparse v0.0.0-20210429162001-6b43995a97de
+require (
+	github.com/araddon/dateparse v0.0.0-20210429162001-6b43995a97de
+	golang.org/x/term v0.21.0
+)
+
+require golang.org/x/sys v0.21.0 // indirect
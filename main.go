@@ -17,23 +17,105 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/jackbister/csql/pkg/csql"
+	"golang.org/x/term"
 )
 
 var versionString string // This must be set using -ldflags "-X main.versionString=<version>" when building for --version to work
 
+var interactive = flag.String("i", "", "Start an interactive session that runs queries on this file")
+var queryFile = flag.String("f", "", "Read the query from this file instead of the command line")
+var format = flag.String("format", "csv", "Output format, one of csv, json or table")
+var parallelism = flag.Int("j", 1, "Number of CPU cores to spread filtering, projection and grouping over")
+var maxGroups = flag.Int("max-groups", 0, "Fail if a step produces more than this many distinct groups, 0 means no limit")
+var maxOrderRows = flag.Int("max-order-rows", 0, "Fail if a step buffers more than this many rows for ordering, 0 means no limit")
+var maxRows = flag.Int("max-rows", 0, "Fail if the input has more than this many rows, 0 means no limit")
 var printOps = flag.Bool("ops", false, "Print operations")
 var printTypes = flag.Bool("types", false, "")
 var printVersion = flag.Bool("version", false, "Print version and exit")
 var separator = flag.String("sep", ",", "")
+var truncate = flag.Bool("truncate", false, "Truncate the result with a warning instead of failing when a -max-* limit is hit")
+var timeout = flag.Duration("timeout", 0, "Abort the query if it runs for longer than this duration, e.g. 30s")
 var skip = flag.Int("skip", 0, "")
+var strict = flag.Bool("strict", false, "Type check the query against the types of the columns in the input before running it")
+var sortMemoryRows = flag.Int("sort-memory-rows", csql.NewOptions().SortMemoryRows, "Number of rows order() sorts in memory before spilling to temporary files, 0 means never spill")
+var toSQL = flag.Bool("to-sql", false, "Print the query translated to SQLite SQL on a table named input instead of running it")
+var tempDir = flag.String("temp-dir", "", "Directory for temporary files used when sorting, defaults to the system temporary directory")
+
+// namedValues collects the name=value pairs given with a repeatable flag,
+// such as -join and -p.
+type namedValues map[string]string
+
+func (n namedValues) String() string {
+	pairs := []string{}
+	for name, value := range n {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (n namedValues) Set(value string) error {
+	name, v, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got: %v", value)
+	}
+	n[name] = v
+	return nil
+}
+
+var joins = namedValues{}
+var parameters = namedValues{}
+
+// explainFormat is the value of -explain, which can be given without a value
+// for the text format or as -explain=json.
+type explainFormat string
+
+func (e *explainFormat) String() string {
+	return string(*e)
+}
+
+func (e *explainFormat) Set(value string) error {
+	switch value {
+	case "true", "text":
+		*e = "text"
+	case "json":
+		*e = "json"
+	case "false":
+		*e = ""
+	default:
+		return fmt.Errorf("expected text or json, got: %v", value)
+	}
+	return nil
+}
+
+func (e *explainFormat) IsBoolFlag() bool {
+	return true
+}
+
+var explain explainFormat
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		if err := runFmt(os.Args[2:]); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	flag.Var(joins, "join", "Make the file at path available to join() as name, given as name=path. Can be repeated")
+	flag.Var(&explain, "explain", "Print the plan of the query instead of running it, as text or with -explain=json as JSON")
+	flag.Var(parameters, "p", "Set the query parameter :name to value, given as name=value. Can be repeated")
 	flag.Parse()
 
 	args := flag.Args()
@@ -46,28 +128,137 @@ func main() {
 		return
 	}
 
-	if len(args) < 1 {
-		panic("No query provided")
-	}
-
 	options := csql.NewOptions()
 	options.PrintOps = *printOps
 	options.PrintTypes = *printTypes
 	options.Separator = *separator
 	options.Skip = *skip
+	options.Strict = *strict
+	options.Parallelism = *parallelism
+	options.SortMemoryRows = *sortMemoryRows
+	if *tempDir != "" {
+		options.TempDir = *tempDir
+	}
+	options.JoinSources = joins
+	options.Parameters = parameters
+	options.MaxInputRows = *maxRows
+	options.MaxGroups = *maxGroups
+	options.MaxOrderRows = *maxOrderRows
+	if *truncate {
+		options.OnLimit = csql.LimitActionTruncate
+	}
 
-	query := args[0]
+	if *interactive != "" {
+		if err := runREPL(*interactive, options); err != nil {
+			panic(err)
+		}
+		return
+	}
 
-	tokens := csql.Tokenize(query)
-	operations, err := csql.ParseQuery(tokens)
+	var queryString string
+	if *queryFile != "" {
+		b, err := os.ReadFile(*queryFile)
+		if err != nil {
+			panic(err)
+		}
+		queryString = string(b)
+	} else if len(args) < 1 {
+		panic("No query provided")
+	} else {
+		queryString = args[0]
+	}
+
+	query, err := csql.Compile(queryString, csql.WithOptions(options))
+	var diagnostic *csql.Diagnostic
+	if errors.As(err, &diagnostic) {
+		fmt.Fprintln(os.Stderr, diagnostic.Highlight(queryString))
+		os.Exit(1)
+	}
 	if err != nil {
 		panic(err)
 	}
 
-	rs, err := csql.Execute(operations, os.Stdin, options)
+	if explain != "" {
+		// The types of the columns are inferred if the input is piped in.
+		var source io.Reader
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			source = os.Stdin
+		}
+		plan, err := query.Explain(source)
+		if err != nil {
+			panic(err)
+		}
+		if explain == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			// Expressions are printed as written, such as $1>1.
+			enc.SetEscapeHTML(false)
+			err = enc.Encode(plan)
+		} else {
+			err = plan.WriteText(os.Stdout)
+		}
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if *toSQL {
+		// The columns are named by the header if there is one and the input
+		// is piped in.
+		var header []string
+		if *skip > 0 && !term.IsTerminal(int(os.Stdin.Fd())) {
+			if utf8.RuneCountInString(*separator) != 1 {
+				fmt.Fprintf(os.Stderr, "invalid separator: %q\n", *separator)
+				os.Exit(1)
+			}
+			r := csv.NewReader(os.Stdin)
+			r.Comma, _ = utf8.DecodeRuneInString(*separator)
+			r.FieldsPerRecord = -1
+			header, err = r.Read()
+			if err != nil && err != io.EOF {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		sql, err := query.ToSQL("input", header)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(sql)
+		return
+	}
+
+	sink := newSink(os.Stdout)
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	err = query.Run(ctx, os.Stdin, sink)
+	if errors.As(err, &diagnostic) {
+		// A parameter without a value is reported when the query is run.
+		fmt.Fprintln(os.Stderr, diagnostic.Highlight(queryString))
+		os.Exit(1)
+	}
 	if err != nil {
 		panic(err)
 	}
-	csvWriter := csv.NewWriter(os.Stdout)
-	csvWriter.WriteAll(rs)
+}
+
+// newSink returns a sink that writes to w in the format given with -format.
+func newSink(w io.Writer) csql.ResultSink {
+	switch *format {
+	case "csv":
+		return csql.NewCSVSink(w, ",", false)
+	case "json":
+		return csql.NewJSONSink(w)
+	case "table":
+		return csql.NewTableSink(w)
+	}
+	panic("unknown output format: " + *format)
 }
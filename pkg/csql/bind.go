@@ -0,0 +1,336 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// operationNames are the names of operations that are not in funcMap or
+// aggregationFuncMap, used when suggesting a name for an unknown function.
+var operationNames = []string{
+	"distinct",
+	"group",
+	"join",
+	"keep",
+	"limit",
+	"order",
+	"pivot",
+	"sample",
+	"tail",
+	"unpivot",
+	"where",
+}
+
+// bind checks that every function in a query exists and is called with the
+// right number and types of arguments, and sets the values of parameters.
+// Parameters that already have a value are not changed, so that operations
+// returned by ParseQuery can be executed more than once.
+func bind(operations [][]Expression, parameters map[string]string, engine *Engine) error {
+	missing, err := bindParameters(operations, parameters, engine)
+	if err != nil {
+		return err
+	}
+	return missing
+}
+
+// bindParameters is like bind, but a parameter without a value is not an
+// error. Instead the error for the first such parameter is returned as
+// missing, so that the value can be given when the query is run.
+func bindParameters(operations [][]Expression, parameters map[string]string, engine *Engine) (missing error, err error) {
+	b := &binder{
+		parameters: map[string]*LiteralExpression{},
+		engine:     engine,
+	}
+	for name, value := range parameters {
+		literal := parseLiteral(value)
+		if literal == nil {
+			return nil, fmt.Errorf("failed to parse the value of parameter :%v: %v", name, value)
+		}
+		literal.source = value
+		b.parameters[name] = literal
+	}
+	for _, ops := range operations {
+		for i, op := range ops {
+			if f, ok := op.(*Funcall); ok {
+				if aggr, ok := b.aggregateCall(f); ok {
+					ops[i] = aggr
+					op = aggr
+				}
+			}
+			if let, ok := op.(*LetExpr); ok {
+				if err := b.bindLet(let); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err := b.bindExpr(op); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.missing, nil
+}
+
+type binder struct {
+	// parameters are the values of the parameters that are defined at the
+	// current step.
+	parameters map[string]*LiteralExpression
+	engine     *Engine
+	// missing is the error for the first parameter without a value, and
+	// unbound counts the uses of parameters without a value.
+	missing error
+	unbound int
+}
+
+// aggregateCall returns a call to an aggregation that was registered with
+// the engine as an aggregating expression, since the parser only knows about
+// the built-in aggregations.
+func (b *binder) aggregateCall(f *Funcall) (*AggregatingExpr, bool) {
+	if _, ok := b.engine.function(f.funcName); ok {
+		return nil, false
+	}
+	if _, ok := b.engine.aggregation(f.funcName); !ok {
+		return nil, false
+	}
+	return &AggregatingExpr{
+		aggregationName: f.funcName,
+		argument:        f.arguments.exprs[0],
+		argumentCount:   len(f.arguments.exprs),
+		pos:             f.pos,
+	}, true
+}
+
+func (b *binder) bindLet(let *LetExpr) error {
+	unbound := b.unbound
+	if err := b.bindExpr(let.value); err != nil {
+		return err
+	}
+	if _, ok := b.parameters[let.name]; ok {
+		return newDiagnostic(let.pos, "parameter :%v is already defined", let.name)
+	}
+	if b.unbound != unbound {
+		// The value depends on a parameter without a value, so it can only
+		// be computed when the query is run.
+		return nil
+	}
+	res, err := let.value.Execute(0, []Value{})
+	if err != nil {
+		return newDiagnostic(let.pos, "the value of let %v must be a constant: %v", let.name, err)
+	}
+	b.parameters[let.name] = &LiteralExpression{
+		value:  *res.value,
+		source: res.value.String(),
+	}
+	return nil
+}
+
+func (b *binder) bindExpr(e Expression) error {
+	switch e := e.(type) {
+	case *Funcall:
+		if err := b.bindFuncall(e); err != nil {
+			return err
+		}
+		return b.bindExprs(e.arguments.exprs...)
+	case *ParameterExpression:
+		if e.value != nil {
+			return nil
+		}
+		value, ok := b.parameters[e.name]
+		if !ok {
+			if b.missing == nil {
+				b.missing = newDiagnostic(e.pos, "parameter :%v is not defined", e.name)
+			}
+			b.unbound++
+			return nil
+		}
+		e.value = value
+		return nil
+	case *AggregatingExpr:
+		if e.function == nil {
+			fn, ok := b.engine.aggregation(e.aggregationName)
+			if !ok {
+				if suggestion := suggestName(e.aggregationName, b.engine.names()); suggestion != "" {
+					return newDiagnostic(e.pos, "aggregation function '%v' not found, did you mean %v?", e.aggregationName, suggestion)
+				}
+				return newDiagnostic(e.pos, "aggregation function '%v' not found", e.aggregationName)
+			}
+			e.function = &fn
+		}
+		if e.argumentCount != 1 {
+			return newDiagnostic(e.pos, "%v requires exactly 1 argument, got: %d", e.aggregationName, e.argumentCount)
+		}
+		return b.bindExpr(e.argument)
+	case *OpEquals:
+		return b.bindExprs(e.lhs, e.rhs)
+	case *OpLt:
+		return b.bindExprs(e.lhs, e.rhs)
+	case *OpGt:
+		return b.bindExprs(e.lhs, e.rhs)
+	case *OpAdd:
+		return b.bindExprs(e.lhs, e.rhs)
+	case *OpSub:
+		return b.bindExprs(e.lhs, e.rhs)
+	case *OpMul:
+		return b.bindExprs(e.lhs, e.rhs)
+	case *OpDiv:
+		return b.bindExprs(e.lhs, e.rhs)
+	case *OpNeg:
+		return b.bindExpr(e.inner)
+	case *WhereExpr:
+		return b.bindExpr(e.inner)
+	case *KeepExpr:
+		return b.bindExpr(e.inner)
+	case *GroupingExpr:
+		return b.bindExprs(e.arguments.exprs...)
+	case *DistinctExpr:
+		return b.bindExprs(e.arguments.exprs...)
+	case *OrderingExpr:
+		return b.bindExpr(e.argument)
+	case *WindowExpr:
+		if e.order != nil {
+			if err := b.bindExpr(e.order); err != nil {
+				return err
+			}
+		}
+		return b.bindExprs(append([]Expression{e.argument}, e.partition.exprs...)...)
+	case *JoinExpr:
+		return b.bindExprs(e.leftKey, e.rightKey)
+	case *PivotExpr:
+		return b.bindExprs(e.rowKey, e.colKey, e.aggregate)
+	}
+	return nil
+}
+
+func (b *binder) bindExprs(exprs ...Expression) error {
+	for _, e := range exprs {
+		if e == nil {
+			continue
+		}
+		if err := b.bindExpr(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *binder) bindFuncall(f *Funcall) error {
+	if f.function != nil {
+		return nil
+	}
+	fn, ok := b.engine.function(f.funcName)
+	if !ok {
+		if suggestion := suggestName(f.funcName, b.engine.names()); suggestion != "" {
+			return newDiagnostic(f.pos, "function '%v' not found, did you mean %v?", f.funcName, suggestion)
+		}
+		return newDiagnostic(f.pos, "function '%v' not found", f.funcName)
+	}
+	args := f.arguments.exprs
+	if !fn.variadic && len(args) < len(fn.argumentTypes) && f.implicit != nil {
+		// If arguments are missing, the implicit column reference is used as
+		// the first argument, so has(ABC) is the same as has($0,ABC).
+		args = append([]Expression{f.implicit}, args...)
+	}
+	if !fn.variadic && len(args) != len(fn.argumentTypes) {
+		return newDiagnostic(f.pos, "%v requires exactly %v, got: %d", f.funcName, argumentCount(len(fn.argumentTypes)), len(args))
+	}
+	if fn.variadic && len(args) < fn.minArguments {
+		return newDiagnostic(f.pos, "%v requires at least %v, got: %d", f.funcName, argumentCount(fn.minArguments), len(args))
+	}
+	if fn.variadic && len(fn.argumentTypes) > 0 && len(args) > len(fn.argumentTypes) {
+		return newDiagnostic(f.pos, "%v requires at most %v, got: %d", f.funcName, argumentCount(len(fn.argumentTypes)), len(args))
+	}
+	for i, arg := range args {
+		if i >= len(fn.argumentTypes) || fn.argumentTypes[i] == ValueTypeUnknown {
+			continue
+		}
+		if typ := staticType(arg); !canConvert(typ, fn.argumentTypes[i]) {
+			return newDiagnostic(f.pos, "argument %d of %v must be %v, got %v", i+1, f.funcName, typeName(fn.argumentTypes[i]), typeName(typ))
+		}
+	}
+	f.arguments.exprs = args
+	f.function = &fn
+	return nil
+}
+
+func argumentCount(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", n)
+}
+
+// staticType returns the type of the result of an expression if it is the
+// same for every row, or ValueTypeUnknown if it depends on the input.
+func staticType(e Expression) ValueType {
+	switch e := e.(type) {
+	case *LiteralExpression:
+		return e.value.typ
+	case *ParameterExpression:
+		if e.value != nil {
+			return e.value.value.typ
+		}
+	case *Funcall:
+		if fn, ok := e.resolved(); ok {
+			return fn.returnType
+		}
+	case *OpEquals, *OpLt, *OpGt, *OpNeg, *WhereExpr:
+		return ValueTypeBool
+	}
+	return ValueTypeUnknown
+}
+
+// suggestName returns the name in names closest to name, or an empty string
+// if there is no name that is close enough to be a likely typo.
+func suggestName(name string, names []string) string {
+	names = slices.Clone(names)
+	sort.Strings(names)
+
+	best := ""
+	bestDistance := max(1, len([]rune(name))/3) + 1
+	for _, n := range names {
+		if d := editDistance(name, n); d < bestDistance {
+			best = n
+			bestDistance = d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
@@ -0,0 +1,110 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Diagnostic is an error at a position in a query. Line and Col are counted
+// from 1, and Col counts characters, not bytes.
+type Diagnostic struct {
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (d *Diagnostic) Error() string {
+	return fmt.Sprintf("line %d, column %d: %v", d.Line, d.Col, d.Msg)
+}
+
+// Highlight returns the error followed by the line of the query it is on,
+// with a caret under the position of the error.
+func (d *Diagnostic) Highlight(query string) string {
+	lines := strings.Split(query, "\n")
+	if d.Line < 1 || d.Line > len(lines) {
+		return d.Error()
+	}
+	line := lines[d.Line-1]
+	caret := strings.Builder{}
+	for i, c := range []rune(line) {
+		if i >= d.Col-1 {
+			break
+		}
+		// Keep tabs so that the caret lines up with the query line.
+		if c == '\t' {
+			caret.WriteRune('\t')
+		} else {
+			caret.WriteRune(' ')
+		}
+	}
+	caret.WriteRune('^')
+	return fmt.Sprintf("%v\n  %v\n  %v", d.Error(), line, caret.String())
+}
+
+// position is the position of an expression in a query, used for errors
+// that are found after parsing.
+type position struct {
+	line int
+	col  int
+}
+
+func tokenPosition(tok Token) position {
+	return position{
+		line: tok.Line,
+		col:  tok.Col,
+	}
+}
+
+func newDiagnostic(pos position, format string, args ...any) *Diagnostic {
+	return &Diagnostic{
+		Line: pos.line,
+		Col:  pos.col,
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// diagnosticAt returns err as a Diagnostic at pos. If err already contains a
+// Diagnostic, that one is returned since its position is more precise.
+func diagnosticAt(pos position, err error) error {
+	var d *Diagnostic
+	if errors.As(err, &d) {
+		return d
+	}
+	return &Diagnostic{
+		Line: pos.line,
+		Col:  pos.col,
+		Msg:  err.Error(),
+	}
+}
+
+// describeToken describes a token for error messages.
+func describeToken(tok Token) string {
+	switch tok.Typ {
+	case TokenTypeComma:
+		return "','"
+	case TokenTypeNewLine:
+		return "new line"
+	case TokenTypeLParen:
+		return "'('"
+	case TokenTypeRParen:
+		return "')'"
+	}
+	return fmt.Sprintf("'%v'", tok.Str)
+}
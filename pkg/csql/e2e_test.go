@@ -17,7 +17,11 @@
 package csql_test
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -734,3 +738,668 @@ func TestSumComplexExpression(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestSliceSink(t *testing.T) {
+	testCsv := `a,1,1.5
+b,2,2.5`
+	query := "$0,$1,$2"
+	tokens := csql.Tokenize(query)
+	exprs, err := csql.ParseQuery(tokens)
+	if err != nil {
+		t.FailNow()
+	}
+	sink := &csql.SliceSink{}
+	err = csql.ExecuteToSink(context.Background(), exprs, strings.NewReader(testCsv), csql.NewOptions(), sink)
+	if err != nil {
+		t.FailNow()
+	}
+	if len(sink.Schema) != 3 {
+		t.FailNow()
+	}
+	if sink.Schema[0].Type != csql.ValueTypeString || sink.Schema[1].Type != csql.ValueTypeInt || sink.Schema[2].Type != csql.ValueTypeDouble {
+		t.Fatalf("unexpected schema: %v", sink.Schema)
+	}
+	if len(sink.Rows) != 2 {
+		t.FailNow()
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	testCsv := `a,1,true`
+	query := "$0,$1"
+	tokens := csql.Tokenize(query)
+	exprs, err := csql.ParseQuery(tokens)
+	if err != nil {
+		t.FailNow()
+	}
+	out := strings.Builder{}
+	err = csql.ExecuteToSink(context.Background(), exprs, strings.NewReader(testCsv), csql.NewOptions(), csql.NewJSONSink(&out))
+	if err != nil {
+		t.FailNow()
+	}
+	expected := "[\n  {\"$0\": \"a\", \"$1\": 1}\n]\n"
+	if out.String() != expected {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+}
+
+func TestTableSink(t *testing.T) {
+	testCsv := `a,1
+bcd,20`
+	query := "$0,$1"
+	tokens := csql.Tokenize(query)
+	exprs, err := csql.ParseQuery(tokens)
+	if err != nil {
+		t.FailNow()
+	}
+	out := strings.Builder{}
+	err = csql.ExecuteToSink(context.Background(), exprs, strings.NewReader(testCsv), csql.NewOptions(), csql.NewTableSink(&out))
+	if err != nil {
+		t.FailNow()
+	}
+	expected := `$0  | $1
+--- | --
+a   |  1
+bcd | 20
+`
+	if out.String() != expected {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+}
+
+func TestTableSinkRaggedRowAfterSample(t *testing.T) {
+	input := strings.Repeat("a,1\n", 1100) + "b,2,3\n"
+	exprs, err := csql.ParseQuery(csql.Tokenize(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := strings.Builder{}
+	err = csql.ExecuteToSink(context.Background(), exprs, strings.NewReader(input), csql.NewOptions(), csql.NewTableSink(&out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if lines[0] != "$0 | $1 | $2" || lines[len(lines)-2] != "b  |  2 | 3" {
+		t.Fatalf("expected the ragged row to add a column, got %q and %q", lines[0], lines[len(lines)-2])
+	}
+}
+
+func TestOrderBySpillsToDisk(t *testing.T) {
+	testCsv := `Peter,3
+Peter,2
+Charles,1
+Peter,4
+Charles,5
+Peter,0
+Charles,2`
+	tempDir := t.TempDir()
+	options := csql.NewOptions()
+	options.SortMemoryRows = 2
+	options.TempDir = tempDir
+	query := "order($1,desc)"
+	tokens := csql.Tokenize(query)
+	exprs, err := csql.ParseQuery(tokens)
+	if err != nil {
+		t.FailNow()
+	}
+	res, err := csql.Execute(exprs, strings.NewReader(testCsv), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"5", "4", "3", "2", "2", "1", "0"}
+	if len(res) != len(expected) {
+		t.Fatalf("expected %d rows, got %d", len(expected), len(res))
+	}
+	for i, e := range expected {
+		if res[i][1] != e {
+			t.Fatalf("unexpected row %d: %v", i, res[i])
+		}
+	}
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected temporary files to be removed, found %d", len(entries))
+	}
+}
+
+func TestOrderByThenLimitLargerThanInput(t *testing.T) {
+	testCsv := `Peter,5
+Charles,4`
+	query := "order($1,asc),limit(10)"
+	tokens := csql.Tokenize(query)
+	exprs, err := csql.ParseQuery(tokens)
+	if err != nil {
+		t.FailNow()
+	}
+	res, err := csql.Execute(exprs, strings.NewReader(testCsv), csql.NewOptions())
+	if err != nil {
+		t.FailNow()
+	}
+	if len(res) != 2 {
+		t.FailNow()
+	}
+	if res[0][0] != "Charles" || res[1][0] != "Peter" {
+		t.FailNow()
+	}
+}
+
+func runQuery(t *testing.T, query string, input string) [][]string {
+	t.Helper()
+	tokens := csql.Tokenize(query)
+	exprs, err := csql.ParseQuery(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := csql.Execute(exprs, strings.NewReader(input), csql.NewOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func expectColumn(t *testing.T, res [][]string, column int, expected ...string) {
+	t.Helper()
+	if len(res) != len(expected) {
+		t.Fatalf("expected %d rows, got %d: %v", len(expected), len(res), res)
+	}
+	for i, e := range expected {
+		if len(res[i]) <= column || res[i][column] != e {
+			t.Fatalf("unexpected row %d, expected %v in column %d: %v", i, e, column, res)
+		}
+	}
+}
+
+func TestOrderByIsStable(t *testing.T) {
+	testCsv := `a,1
+b,0
+c,1
+d,0
+e,1`
+	res := runQuery(t, "order($1)", testCsv)
+	expectColumn(t, res, 0, "b", "d", "a", "c", "e")
+	res = runQuery(t, "order($1,desc)", testCsv)
+	expectColumn(t, res, 0, "a", "c", "e", "b", "d")
+}
+
+func TestOrderByMoreThanTenKeys(t *testing.T) {
+	testCsv := `0,0,0,0,0,0,0,0,0,0,0,2
+0,0,0,0,0,0,0,0,0,0,0,1`
+	res := runQuery(t, "order(),order(),order(),order(),order(),order(),order(),order(),order(),order(),order(),order()", testCsv)
+	expectColumn(t, res, 11, "1", "2")
+}
+
+func TestOrderByMixedTypes(t *testing.T) {
+	testCsv := `b
+10
+true
+1.5
+a
+2`
+	res := runQuery(t, "order()", testCsv)
+	expectColumn(t, res, 0, "true", "1.5", "2", "10", "a", "b")
+}
+
+func TestOrderByNocase(t *testing.T) {
+	testCsv := `b
+C
+a
+B`
+	res := runQuery(t, "order($0,asc,nocase)", testCsv)
+	expectColumn(t, res, 0, "a", "b", "B", "C")
+}
+
+func TestOrderByNatural(t *testing.T) {
+	testCsv := `file10
+file2
+file1
+file02b`
+	res := runQuery(t, "order($0,asc,natural)", testCsv)
+	expectColumn(t, res, 0, "file1", "file2", "file02b", "file10")
+}
+
+func TestOrderByNulls(t *testing.T) {
+	testCsv := `a,2
+b
+c,1`
+	res := runQuery(t, "order($1)", testCsv)
+	expectColumn(t, res, 0, "b", "c", "a")
+	res = runQuery(t, "order($1,asc,nulls last)", testCsv)
+	expectColumn(t, res, 0, "c", "a", "b")
+	res = runQuery(t, "order($1,desc)", testCsv)
+	expectColumn(t, res, 0, "a", "c", "b")
+	res = runQuery(t, "order($1,desc,nulls first)", testCsv)
+	expectColumn(t, res, 0, "b", "a", "c")
+}
+
+func TestDistinct(t *testing.T) {
+	testCsv := `b,1,x
+a,1,y
+b,1,x
+a,2,z
+b,1,x`
+	res := runQuery(t, "distinct()", testCsv)
+	expectColumn(t, res, 2, "x", "y", "z")
+	res = runQuery(t, "distinct($0)", testCsv)
+	expectColumn(t, res, 2, "x", "y")
+	res = runQuery(t, "distinct($1,$0)", testCsv)
+	expectColumn(t, res, 2, "x", "y", "z")
+}
+
+func TestDistinctWithProjectionOrGroup(t *testing.T) {
+	for _, query := range []string{"$1,distinct()", "group($0),sum($1),distinct()", "=a,distinct()"} {
+		if _, err := csql.Compile(query); err == nil || !strings.Contains(err.Error(), "distinct can only be used") {
+			t.Fatalf("expected %q to be rejected, got %v", query, err)
+		}
+	}
+	res := runQuery(t, "$1\ndistinct()", "a,1\nb,1\nc,2")
+	expectColumn(t, res, 0, "1", "2")
+}
+
+func TestDistinctDoesNotConfuseTypes(t *testing.T) {
+	testCsv := `1,a
+1.0,b
+1,c`
+	res := runQuery(t, "distinct($0)", testCsv)
+	expectColumn(t, res, 1, "a", "b")
+}
+
+func TestLimitLargerThanInput(t *testing.T) {
+	res := runQuery(t, "limit(10)", "a\nb")
+	expectColumn(t, res, 0, "a", "b")
+}
+
+func TestLimitOffset(t *testing.T) {
+	testCsv := "a,3\nb,1\nc,5\nd,2\ne,4"
+	res := runQuery(t, "limit(2,1)", testCsv)
+	expectColumn(t, res, 0, "b", "c")
+	res = runQuery(t, "limit(2,4)", testCsv)
+	expectColumn(t, res, 0, "e")
+	res = runQuery(t, "order($1),limit(2,1)", testCsv)
+	expectColumn(t, res, 0, "d", "a")
+	res = runQuery(t, "order($1)\nlimit(2,3)", testCsv)
+	expectColumn(t, res, 0, "e", "c")
+}
+
+func TestTail(t *testing.T) {
+	testCsv := "a,3\nb,1\nc,5\nd,2\ne,4"
+	res := runQuery(t, "tail(2)", testCsv)
+	expectColumn(t, res, 0, "d", "e")
+	res = runQuery(t, "tail(10)", testCsv)
+	expectColumn(t, res, 0, "a", "b", "c", "d", "e")
+	res = runQuery(t, "order($1),tail(2)", testCsv)
+	expectColumn(t, res, 0, "e", "c")
+	res = runQuery(t, "tail(0)", testCsv)
+	expectColumn(t, res, 0)
+	// The limit in the next step applies to the tail of the ordered rows.
+	res = runQuery(t, "order($1),tail(2)\nlimit(1)", testCsv)
+	expectColumn(t, res, 0, "e")
+	// The buffer must not be allocated up front for n rows.
+	res = runQuery(t, "tail(100000000000)", testCsv)
+	expectColumn(t, res, 0, "a", "b", "c", "d", "e")
+}
+
+func TestSample(t *testing.T) {
+	testCsv := strings.Builder{}
+	for i := 0; i < 100; i++ {
+		testCsv.WriteString(strconv.Itoa(i) + "\n")
+	}
+	first := runQuery(t, "sample(10,42)", testCsv.String())
+	second := runQuery(t, "sample(10,42)", testCsv.String())
+	if len(first) != 10 || !reflect.DeepEqual(first, second) {
+		t.Fatalf("expected the same 10 rows from a seeded sample, got %v and %v", first, second)
+	}
+	for i := 1; i < len(first); i++ {
+		prev, _ := strconv.Atoi(first[i-1][0])
+		cur, _ := strconv.Atoi(first[i][0])
+		if prev >= cur {
+			t.Fatalf("expected sampled rows in input order: %v", first)
+		}
+	}
+	// The limit in the next step applies to the sample of the ordered rows.
+	sampled := runQuery(t, "order($0,desc),sample(3,1)", testCsv.String())
+	res := runQuery(t, "order($0,desc),sample(3,1)\nlimit(1)", testCsv.String())
+	if len(res) != 1 || res[0][0] != sampled[0][0] {
+		t.Fatalf("expected the first sampled row %v, got %v", sampled[0], res)
+	}
+	res = runQuery(t, "sample(10)", "a\nb")
+	expectColumn(t, res, 0, "a", "b")
+	res = runQuery(t, "sample(100000000000)", "a\nb\nc")
+	expectColumn(t, res, 0, "a", "b", "c")
+}
+
+func TestOnlyOneLimitPerStep(t *testing.T) {
+	_, err := csql.Compile("limit(1),tail(1)")
+	if err == nil {
+		t.Fatal("expected an error for limit and tail in the same step")
+	}
+}
+
+func TestWindowFunctions(t *testing.T) {
+	testCsv := `A,1
+B,5
+A,3
+B,2
+A,3`
+	res := runQuery(t, "$0,rownum(),rownum(over($0)),cumsum($1,over($0)),lag($1,1,over($0)),lead($1),movavg($1,2)", testCsv)
+	expectColumn(t, res, 1, "1", "2", "3", "4", "5")
+	expectColumn(t, res, 2, "1", "1", "2", "2", "3")
+	expectColumn(t, res, 3, "1", "5", "4", "7", "7")
+	expectColumn(t, res, 4, "", "", "1", "5", "3")
+	expectColumn(t, res, 5, "5", "3", "2", "3", "")
+	expectColumn(t, res, 6, "1", "3", "4", "2.5", "2.5")
+}
+
+func TestWindowRank(t *testing.T) {
+	testCsv := `A,1
+B,5
+A,3
+B,2
+A,3`
+	res := runQuery(t, "rank($1)", testCsv)
+	expectColumn(t, res, 0, "1", "5", "3", "2", "3")
+	res = runQuery(t, "rank($1,desc,over($0))", testCsv)
+	expectColumn(t, res, 0, "3", "1", "1", "2", "1")
+}
+
+func TestWindowAfterFilter(t *testing.T) {
+	testCsv := `A,1
+B,5
+A,3`
+	res := runQuery(t, "=A,$1,cumsum($1)", testCsv)
+	expectColumn(t, res, 0, "1", "3")
+	expectColumn(t, res, 1, "1", "4")
+}
+
+func TestWindowCannotBeGrouped(t *testing.T) {
+	_, err := csql.Compile("group(),rownum()")
+	if err == nil {
+		t.Fatal("expected an error for a window function in a grouping step")
+	}
+}
+
+func TestPivot(t *testing.T) {
+	testCsv := `d1,AAPL,10
+d1,XOM,5
+d2,AAPL,3
+d1,AAPL,1`
+	res := runQuery(t, "pivot($0,$1,sum($2))", testCsv)
+	expected := [][]string{{"", "AAPL", "XOM"}, {"d1", "11", "5"}, {"d2", "3", ""}}
+	if fmt.Sprint(res) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestUnpivot(t *testing.T) {
+	res := runQuery(t, "unpivot($1..$2)", "a,1,2\nb,3,4")
+	expected := [][]string{{"a", "$1", "1"}, {"a", "$2", "2"}, {"b", "$1", "3"}, {"b", "$2", "4"}}
+	if fmt.Sprint(res) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	res = runQuery(t, "pivot($0,$1,sum($2))\nunpivot($1..$2,header)", "d1,AAPL,10\nd1,XOM,5\nd2,AAPL,3")
+	expected = [][]string{{"d1", "AAPL", "10"}, {"d1", "XOM", "5"}, {"d2", "AAPL", "3"}, {"d2", "XOM", ""}}
+	if fmt.Sprint(res) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestUnpivotRowTooShort(t *testing.T) {
+	_, err := csql.Execute(mustParse(t, "unpivot($1..$2)"), strings.NewReader("a,1,2\nb,3"), csql.NewOptions())
+	if err == nil || !strings.Contains(err.Error(), "row 2") {
+		t.Fatalf("expected an error for row 2, got %v", err)
+	}
+}
+
+func mustParse(t *testing.T, query string) [][]csql.Expression {
+	t.Helper()
+	exprs, err := csql.ParseQuery(csql.Tokenize(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exprs
+}
+
+func TestColumnRanges(t *testing.T) {
+	testCsv := "a,1,x,9\nb,2,y,8"
+	expectRows := func(query string, expected [][]string) {
+		t.Helper()
+		res := runQuery(t, query, testCsv)
+		if fmt.Sprint(res) != fmt.Sprint(expected) {
+			t.Fatalf("%v: expected %v, got %v", query, expected, res)
+		}
+	}
+	expectRows("$*", [][]string{{"a", "1", "x", "9"}, {"b", "2", "y", "8"}})
+	expectRows("$1..$2", [][]string{{"1", "x"}, {"2", "y"}})
+	expectRows("$-1,$0", [][]string{{"9", "a"}, {"8", "b"}})
+	expectRows("$*!$2", [][]string{{"a", "1", "9"}, {"b", "2", "8"}})
+	expectRows("$*!$0!$-1", [][]string{{"1", "x"}, {"2", "y"}})
+	expectRows("$-2..$-1", [][]string{{"x", "9"}, {"y", "8"}})
+	expectRows("group($0..$1)", [][]string{{"a", "1"}, {"b", "2"}})
+}
+
+func TestColumnRangesInDistinct(t *testing.T) {
+	res := runQuery(t, "distinct($*!$-1)", "a,1,x\na,1,y\nb,2,z")
+	expectColumn(t, res, 2, "x", "z")
+}
+
+func TestColumnOutOfRangeReportsRow(t *testing.T) {
+	_, err := csql.Execute(mustParse(t, "$3"), strings.NewReader("a,1,x,9\nb,2,y"), csql.NewOptions())
+	if err == nil || !strings.Contains(err.Error(), "step 1, row 2") {
+		t.Fatalf("expected an error for row 2, got %v", err)
+	}
+}
+
+func TestIf(t *testing.T) {
+	testCsv := "AAPL,100\nXOM,-5\nIBM,0"
+	res := runQuery(t, "$0,if(>0,BUY,SELL),if($1<0,true,false)", testCsv)
+	expectColumn(t, res, 1, "BUY", "SELL", "SELL")
+	expectColumn(t, res, 2, "false", "true", "false")
+}
+
+func TestIfIsLazy(t *testing.T) {
+	res := runQuery(t, "if(true,$0,$9)", "a\nb")
+	expectColumn(t, res, 0, "a", "b")
+}
+
+func TestCase(t *testing.T) {
+	testCsv := "AAPL,100\nXOM,-5\nIBM,0"
+	res := runQuery(t, "$0,case($1>50,big,$1>0,small,$1<0,negative,zero),case($1>50,big)", testCsv)
+	expectColumn(t, res, 1, "big", "negative", "zero")
+	expectColumn(t, res, 2, "big", "", "")
+}
+
+func TestIfRequiresBooleanCondition(t *testing.T) {
+	_, err := csql.Execute(mustParse(t, "if($0,a,b)"), strings.NewReader("x"), csql.NewOptions())
+	if err == nil || !strings.Contains(err.Error(), `"x"`) {
+		t.Fatalf("expected an error naming the condition that is not a boolean, got %v", err)
+	}
+}
+
+func TestNullConditionIsFalse(t *testing.T) {
+	testCsv := "a,true\nb,\nc,false"
+	res := runQuery(t, "$0,if($1,y,n)", testCsv)
+	expectColumn(t, res, 1, "y", "n", "n")
+	res = runQuery(t, "$0,case($1,y,n)", testCsv)
+	expectColumn(t, res, 1, "y", "n", "n")
+}
+
+func TestExplicitFilterAndProjection(t *testing.T) {
+	testCsv := "AAPL,100,true\nXOM,5,false\nIBM,200,false"
+	res := runQuery(t, "$0,keep($1>50)", testCsv)
+	expectColumn(t, res, 1, "true", "false", "true")
+	res = runQuery(t, "keep($2),$0", testCsv)
+	expectColumn(t, res, 0, "true", "false", "false")
+	res = runQuery(t, "$0,?$1>50", testCsv)
+	expectColumn(t, res, 0, "AAPL", "IBM")
+	res = runQuery(t, "where($1>50),$0", testCsv)
+	expectColumn(t, res, 0, "AAPL", "IBM")
+	// Without a marker, boolean results are still filters.
+	res = runQuery(t, "$0,$2", testCsv)
+	expectColumn(t, res, 0, "AAPL")
+	// A ? that does not start an operation is part of a literal.
+	res = runQuery(t, "=what?,$1", "what?,1\nwhat,2\nhttp://a/?b=1,3")
+	expectColumn(t, res, 0, "1")
+	res = runQuery(t, "?has(what?)", "what?,1\nwhat,2\nhttp://a/?b=1,3")
+	expectColumn(t, res, 1, "1")
+}
+
+func TestWhereRequiresBoolean(t *testing.T) {
+	_, err := csql.Execute(mustParse(t, "where($0)"), strings.NewReader("a"), csql.NewOptions())
+	if err == nil {
+		t.Fatal("expected an error for a filter that is not a boolean")
+	}
+}
+
+func TestCasts(t *testing.T) {
+	testCsv := "AAPL,100,1700000000,true,2.5"
+	res := runQuery(t, "str($1),float($1),int($4),keep(bool($1)),int($3),date($2),int(date($2)),date($2,epochms),float(true)", testCsv)
+	expected := [][]string{{"100", "100", "2", "true", "1", "2023-11-14 22:13:20 +0000 UTC", "1700000000", "1970-01-20 16:13:20 +0000 UTC", "1"}}
+	if fmt.Sprint(res) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestDateWithLayout(t *testing.T) {
+	res := runQuery(t, "int(date($0,20060102))", "20240102")
+	expectColumn(t, res, 0, "1704153600")
+}
+
+func TestCastFailure(t *testing.T) {
+	_, err := csql.Execute(mustParse(t, "int($0)"), strings.NewReader("abc"), csql.NewOptions())
+	if err == nil || !strings.Contains(err.Error(), "cannot convert") {
+		t.Fatalf("expected a conversion error, got %v", err)
+	}
+}
+
+func TestIntCastDoesNotTruncateStrings(t *testing.T) {
+	for _, input := range []string{"2.7", "1e30"} {
+		_, err := csql.Execute(mustParse(t, "int(str($0))"), strings.NewReader(input), csql.NewOptions())
+		if err == nil || !strings.Contains(err.Error(), "cannot convert") {
+			t.Fatalf("expected %q to not be converted to int, got %v", input, err)
+		}
+	}
+	_, err := csql.Execute(mustParse(t, "int($0)"), strings.NewReader("1e30"), csql.NewOptions())
+	if err == nil || !strings.Contains(err.Error(), "cannot convert") {
+		t.Fatalf("expected 1e30 to overflow int, got %v", err)
+	}
+	res := runQuery(t, "int(str($0))", "1e3")
+	expectColumn(t, res, 0, "1000")
+}
+
+func TestStrictTypeCheck(t *testing.T) {
+	testCsv := "AAPL,100,2024.01.02\nXOM,5,2024.01.03"
+	run := func(query string) error {
+		t.Helper()
+		q, err := csql.Compile(query, csql.WithStrict(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q.Run(context.Background(), strings.NewReader(testCsv), &csql.SliceSink{})
+	}
+	if err := run("$0,$1+1,date($2)\n$1*2,$2>$2"); err != nil {
+		t.Fatal(err)
+	}
+	err := run("$0,$1+$2")
+	if err == nil || err.Error() != "step 1: cannot add int and date in column 1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = run("$0,$1\n$1,$0*2")
+	if err == nil || err.Error() != "step 2: cannot multiply string and int in column 1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = run("$5")
+	if err == nil || !strings.Contains(err.Error(), "column $5 does not exist") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = run("group($0),sum($2)")
+	if err == nil || !strings.Contains(err.Error(), "cannot sum date") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCommentsAndContinuations(t *testing.T) {
+	testCsv := "AAPL,10,200\nAAPL,5,150\nMSFT,1,1\nA#B,1,1"
+	query := `# Total traded value per ticker
+=AAPL,,>100   # only big trades
+
+group(),\
+    sum($1*$2)
+`
+	res := runQuery(t, query, testCsv)
+	expected := [][]string{{"AAPL", "2750"}}
+	if fmt.Sprint(res) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	res = runQuery(t, "=A#B", testCsv)
+	expectColumn(t, res, 0, "A#B")
+
+	// Queries saved with Windows line endings.
+	res = runQuery(t, strings.ReplaceAll(query, "\n", "\r\n"), testCsv)
+	if fmt.Sprint(res) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v with CRLF line endings, got %v", expected, res)
+	}
+	res = runQuery(t, "=MSFT\r\n$0\r\n", testCsv)
+	expectColumn(t, res, 0, "MSFT")
+}
+
+func TestParameters(t *testing.T) {
+	testCsv := "BRK-B,10,2024.01.02\nAAPL,5,2024.01.03\nXOM,20,2024.01.03"
+	run := func(query string, opts ...csql.Option) ([][]string, error) {
+		t.Helper()
+		q, err := csql.Compile(query, opts...)
+		if err != nil {
+			return nil, err
+		}
+		sink := &csql.StringSliceSink{}
+		err = q.Run(context.Background(), strings.NewReader(testCsv), sink)
+		return sink.Rows, err
+	}
+
+	res, err := run("=:ticker\n$1", csql.WithParameter("ticker", "BRK-B"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectColumn(t, res, 0, "10")
+
+	res, err = run("let min = :base*2\n,>:min,=:day\n$0", csql.WithParameter("base", "4"), csql.WithParameter("day", "2024-01-03"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectColumn(t, res, 0, "XOM")
+
+	res, err = run("let n = int(7.9)\n$0,:n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectColumn(t, res, 1, "7", "7", "7")
+
+	_, err = run("=:missing")
+	if err == nil || !strings.Contains(err.Error(), "parameter :missing is not defined") {
+		t.Fatalf("expected an undefined parameter error, got %v", err)
+	}
+	_, err = run("let x = $0")
+	if err == nil || !strings.Contains(err.Error(), "must be a constant") {
+		t.Fatalf("expected a constant error, got %v", err)
+	}
+}
+
+func TestMacros(t *testing.T) {
+	testCsv := "AAPL,10,200\nAAPL,5,150\nMSFT,1,1"
+	res := runQuery(t, "def notional = $1*$2\ndef big = >1000\ngroup($0),sum(notional)\n,big", testCsv)
+	expected := [][]string{{"AAPL", "2750"}}
+	if fmt.Sprint(res) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	res = runQuery(t, "def notional = $1*$2\n$0,notional,notional", testCsv)
+	expectColumn(t, res, 2, "2000", "750", "1")
+
+	for _, query := range []string{"def a = b\ndef b = a\n=a", "def n = $1,$2", "def n = 1\ndef n = 2"} {
+		if _, err := csql.Compile(query); err == nil {
+			t.Fatalf("expected an error for %q", query)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Engine compiles queries. Functions and aggregations that are registered
+// with an Engine can be used in the queries it compiles, in addition to the
+// built-in ones. Functions must not be registered while the Engine is
+// compiling a query.
+type Engine struct {
+	functions    map[string]Function
+	aggregations map[string]AggregationFunction
+}
+
+func NewEngine() *Engine {
+	return &Engine{
+		functions:    map[string]Function{},
+		aggregations: map[string]AggregationFunction{},
+	}
+}
+
+// RegisterFunction adds a function to the engine. Before fn is called, each
+// argument is converted to its type in argumentTypes unless the type is
+// ValueTypeUnknown or the argument is null. As for the built-in functions,
+// the column of the operation is used as the first argument if a call has
+// one argument less than argumentTypes.
+func (e *Engine) RegisterFunction(name string, argumentTypes []ValueType, returnType ValueType, fn func(args []Value) (Value, error)) error {
+	if err := e.checkName(name); err != nil {
+		return err
+	}
+	if fn == nil {
+		return fmt.Errorf("function %v must not be nil", name)
+	}
+	argumentTypes = slices.Clone(argumentTypes)
+	e.functions[name] = Function{
+		argumentTypes: argumentTypes,
+		returnType:    returnType,
+		fn: func(args ExpressionList, i int, record []Value) (*Value, error) {
+			values := make([]Value, len(args.exprs))
+			for j, arg := range args.exprs {
+				v, err := evaluateArgument(arg, i, record)
+				if err != nil {
+					return nil, err
+				}
+				if argumentTypes[j] != ValueTypeUnknown && !v.IsNull() {
+					v, err = v.Convert(argumentTypes[j])
+					if err != nil {
+						return nil, err
+					}
+				}
+				values[j] = *v
+			}
+			res, err := fn(values)
+			if err != nil {
+				return nil, err
+			}
+			return &res, nil
+		},
+	}
+	return nil
+}
+
+// RegisterAggregate adds an aggregation to the engine. Like sum, fn combines
+// the aggregated value of the rows so far with the value of the next row.
+// Both values are converted to valueType before fn is called.
+func (e *Engine) RegisterAggregate(name string, valueType ValueType, fn func(a, b Value) (Value, error)) error {
+	if err := e.checkName(name); err != nil {
+		return err
+	}
+	if fn == nil {
+		return fmt.Errorf("function %v must not be nil", name)
+	}
+	e.aggregations[name] = AggregationFunction{
+		valueType: valueType,
+		fn: func(a, b Value) (*Value, error) {
+			res, err := fn(a, b)
+			if err != nil {
+				return nil, err
+			}
+			return &res, nil
+		},
+	}
+	return nil
+}
+
+func (e *Engine) checkName(name string) error {
+	if !isIdentifier(name) {
+		return fmt.Errorf("invalid function name: %q", name)
+	}
+	if slices.Contains(e.names(), name) {
+		return fmt.Errorf("function %v is already defined", name)
+	}
+	return nil
+}
+
+// FunctionNames returns the sorted names of all functions and operations
+// that can be used in queries compiled by the engine.
+func (e *Engine) FunctionNames() []string {
+	names := e.names()
+	slices.Sort(names)
+	return names
+}
+
+func (e *Engine) function(name string) (Function, bool) {
+	if fn, ok := e.functions[name]; ok {
+		return fn, true
+	}
+	fn, ok := funcMap[name]
+	return fn, ok
+}
+
+func (e *Engine) aggregation(name string) (AggregationFunction, bool) {
+	if fn, ok := e.aggregations[name]; ok {
+		return fn, true
+	}
+	fn, ok := aggregationFuncMap[name]
+	return fn, ok
+}
+
+// names returns the names of all functions and operations that can be used
+// in queries compiled by the engine.
+func (e *Engine) names() []string {
+	names := slices.Clone(operationNames)
+	names = append(names, windowFunctionNames...)
+	for _, m := range []map[string]Function{funcMap, e.functions} {
+		for name := range m {
+			names = append(names, name)
+		}
+	}
+	for _, m := range []map[string]AggregationFunction{aggregationFuncMap, e.aggregations} {
+		for name := range m {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -17,10 +17,17 @@
 package csql
 
 import (
+	"cmp"
+	"context"
 	"encoding/csv"
 	"fmt"
 	"io"
+	"math/rand"
+	"os"
 	"slices"
+	"strconv"
+	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -29,266 +36,1009 @@ type GroupOperations struct {
 	projectionExprs []*AggregatingExpr
 }
 
-func Execute(operations [][]Expression, reader io.Reader, options Options) ([][]string, error) {
-	if options.PrintOps {
-		for _, ops := range operations {
-			fmt.Println(ops)
+type stepOperations struct {
+	groupOperations GroupOperations
+	distinctExpr    *DistinctExpr
+	orderOperations []*OrderingExpr
+	limitOperations []*LimitExpr
+	tailExpr        *TailExpr
+	sampleExpr      *SampleExpr
+	windowExprs     []*WindowExpr
+	joinExpr        *JoinExpr
+	pivotExpr       *PivotExpr
+	unpivotExpr     *UnpivotExpr
+	letExpr         *LetExpr
+}
+
+// hasRowLimit returns true if the step has a limit, tail or sample operation.
+func (s *stepOperations) hasRowLimit() bool {
+	return len(s.limitOperations) > 0 || s.tailExpr != nil || s.sampleExpr != nil
+}
+
+func classifyStep(ops []Expression) (*stepOperations, error) {
+	step := &stepOperations{
+		groupOperations: GroupOperations{
+			projectionExprs: make([]*AggregatingExpr, 0),
+		},
+		orderOperations: make([]*OrderingExpr, 0),
+		limitOperations: make([]*LimitExpr, 0),
+	}
+	for _, op := range ops {
+		switch slotRole(op) {
+		case roleGrouping:
+			if step.groupOperations.groupExpr != nil {
+				return nil, fmt.Errorf("cannot have more than one grouping expr in a line")
+			}
+			step.groupOperations.groupExpr = op.(*GroupingExpr)
+		case roleAggregation:
+			fnc := op.(*AggregatingExpr)
+			if err := checkAggregation(fnc); err != nil {
+				return nil, err
+			}
+			step.groupOperations.projectionExprs = append(step.groupOperations.projectionExprs, fnc)
+		case roleDistinct:
+			if step.distinctExpr != nil {
+				return nil, fmt.Errorf("cannot have more than one distinct expression in a line")
+			}
+			step.distinctExpr = op.(*DistinctExpr)
+		case roleOrdering:
+			step.orderOperations = append(step.orderOperations, op.(*OrderingExpr))
+		case roleLimit:
+			if step.hasRowLimit() {
+				return nil, fmt.Errorf("cannot have more than one limit, tail or sample expression in a line")
+			}
+			switch op := op.(type) {
+			case *LimitExpr:
+				step.limitOperations = append(step.limitOperations, op)
+			case *TailExpr:
+				step.tailExpr = op
+			case *SampleExpr:
+				step.sampleExpr = op
+			}
+		case roleWindow:
+			step.windowExprs = append(step.windowExprs, op.(*WindowExpr))
+		case roleLet:
+			step.letExpr = op.(*LetExpr)
+		case roleJoin, rolePivot:
+			switch op := op.(type) {
+			case *JoinExpr:
+				step.joinExpr = op
+			case *PivotExpr:
+				step.pivotExpr = op
+			case *UnpivotExpr:
+				step.unpivotExpr = op
+			}
+			if len(ops) > 1 {
+				return nil, fmt.Errorf("join, pivot and unpivot must be the only expression in a line")
+			}
 		}
 	}
-	csvReader := csv.NewReader(reader)
-	sep, _ := utf8.DecodeRuneInString(options.Separator)
-	if sep == utf8.RuneError {
-		panic("invalid separator")
+	if len(step.windowExprs) > 0 {
+		if step.groupOperations.groupExpr != nil || len(step.groupOperations.projectionExprs) > 0 {
+			return nil, fmt.Errorf("window functions cannot be used in the same line as group or aggregating expressions")
+		}
+		if step.distinctExpr != nil || len(step.orderOperations) > 0 || step.hasRowLimit() {
+			return nil, fmt.Errorf("window functions cannot be used in the same line as distinct, order, limit, tail or sample expressions")
+		}
 	}
-	csvReader.Comma = sep
-	csvReader.FieldsPerRecord = -1
+	if step.distinctExpr != nil {
+		// Distinct applies to the rows coming into the step, so anything that
+		// changes them in the same line would be ignored.
+		for _, op := range ops {
+			switch op.Type() {
+			case ExpressionDistinct, ExpressionOrdering, ExpressionLimit, ExpressionTail, ExpressionSample, ExpressionNop:
+			default:
+				return nil, fmt.Errorf("distinct can only be used in the same line as order, limit, tail or sample expressions, put it on its own line after filters, projections and grouping")
+			}
+		}
+	}
+	return step, nil
+}
 
-	records, err := csvReader.ReadAll()
-	if err != nil {
+func checkAggregation(aggr *AggregatingExpr) error {
+	if _, ok := aggr.resolved(); !ok {
+		return newDiagnostic(aggr.pos, "aggregation function '%v' not found", aggr.aggregationName)
+	}
+	return nil
+}
+
+// validateQuery checks each step of a query. Errors are reported at the
+// position in positions of the step they were found in.
+func validateQuery(operations [][]Expression, positions []position) error {
+	for i, ops := range operations {
+		if _, err := classifyStep(ops); err != nil {
+			return diagnosticAt(positions[i], fmt.Errorf("step %d: %w", i+1, err))
+		}
+	}
+	return nil
+}
+
+func Execute(operations [][]Expression, reader io.Reader, options Options) ([][]string, error) {
+	sink := &StringSliceSink{}
+	if err := ExecuteToSink(context.Background(), operations, reader, options, sink); err != nil {
 		return nil, err
 	}
+	return sink.Rows, nil
+}
+
+// contextCheckInterval is how many records or comparisons are processed
+// between each check of whether the context has been cancelled.
+const contextCheckInterval = 1024
 
-	if options.Skip != 0 {
-		records = records[options.Skip:]
+// ExecuteToSink runs operations returned by ParseQuery, which can only use
+// the built-in functions. Compiled queries are run with Query.Run instead.
+func ExecuteToSink(ctx context.Context, operations [][]Expression, reader io.Reader, options Options, sink ResultSink) error {
+	if err := bind(operations, options.Parameters, NewEngine()); err != nil {
+		return err
 	}
+	return execute(ctx, operations, reader, options, sink)
+}
 
-	resultSet := make([][]Value, len(records))
-	for i, r := range records {
-		resultSet[i] = make([]Value, len(r))
-		for j, v := range r {
-			literalExpr := parseLiteral(v)
-			resultSet[i][j] = literalExpr.value
+// execute runs operations that have been bound.
+func execute(ctx context.Context, operations [][]Expression, reader io.Reader, options Options, sink ResultSink) error {
+	if options.PrintOps {
+		writeOps(os.Stdout, operations)
+	}
+	source, err := newCSVSource(ctx, reader, options)
+	if err != nil {
+		return err
+	}
+
+	cleanup := []func(){}
+	defer func() {
+		for _, c := range cleanup {
+			c()
 		}
+	}()
+
+	var rows rowIterator = source
+	if options.Parallelism > 1 {
+		source.parseFields = false
+		parse := newParallelParseStage(source, options.Parallelism)
+		cleanup = append(cleanup, parse.close)
+		rows = parse
 	}
+	if options.Strict {
+		sample, sampled, err := sampleRows(rows, schemaSampleRows)
+		if err != nil {
+			return err
+		}
+		schema := inferSchema(sample)
+		types := make([]ValueType, len(schema))
+		for i, c := range schema {
+			types[i] = c.Type
+		}
+		if err := typeCheck(operations, types); err != nil {
+			return err
+		}
+		rows = sampled
+	}
+	for stepIdx, ops := range operations {
+		step, err := classifyStep(ops)
+		if err != nil {
+			return err
+		}
+		if step.letExpr != nil {
+			// Let steps only define parameters, which is done by bind.
+			continue
+		}
+		groupOperations := step.groupOperations
+		orderOperations := step.orderOperations
+		limitOperations := step.limitOperations
 
-	for _, ops := range operations {
-		nextResultSet := [][]Value{}
-		groupOperations := GroupOperations{
-			projectionExprs: make([]*AggregatingExpr, 0),
+		if step.distinctExpr != nil && groupOperations.groupExpr == nil && len(groupOperations.projectionExprs) == 0 {
+			rows = &distinctStage{
+				input:        rows,
+				distinctExpr: step.distinctExpr,
+				seen:         map[string]struct{}{},
+				step:         stepIdx + 1,
+			}
 		}
-		groupingValues := map[string][]Value{}
-		groupedResults := map[string][]Value{}
-		orderOperations := make([]*OrderingExpr, 0)
-		limitOperations := make([]*LimitExpr, 0)
 
-		for _, op := range ops {
-			if op.Type() == ExpressionGrouping {
-				if groupOperations.groupExpr != nil {
-					panic("cannot have more than one grouping expr in a line")
+		if step.joinExpr != nil {
+			rows = &joinStage{
+				ctx:      ctx,
+				input:    rows,
+				joinExpr: step.joinExpr,
+				options:  &options,
+			}
+		} else if step.pivotExpr != nil {
+			if err := checkAggregation(step.pivotExpr.aggregate); err != nil {
+				return err
+			}
+			rows = newPivotStage(rows, step.pivotExpr, &options, stepIdx+1)
+		} else if step.unpivotExpr != nil {
+			rows = &unpivotStage{
+				input:       rows,
+				unpivotExpr: step.unpivotExpr,
+			}
+		} else if groupOperations.groupExpr != nil || len(groupOperations.projectionExprs) > 0 {
+			rows = &groupStage{
+				input:           rows,
+				groupOperations: groupOperations,
+				options:         &options,
+				step:            stepIdx + 1,
+			}
+		} else if len(orderOperations) > 0 || step.hasRowLimit() {
+			if len(orderOperations) > 0 {
+				// If the rows are limited right after ordering, only the top
+				// rows need to be kept instead of sorting the whole input. A
+				// tail or sample in the same step needs all the ordered rows.
+				var limit *LimitExpr
+				if len(limitOperations) > 0 {
+					limit = limitOperations[0]
+				} else if !step.hasRowLimit() && stepIdx+1 < len(operations) && isLimitStep(operations[stepIdx+1]) {
+					limit = operations[stepIdx+1][0].(*LimitExpr)
 				}
-				groupOperations.groupExpr = op.(*GroupingExpr)
-			} else if op.Type() == ExpressionAggregating {
-				fnc := op.(*AggregatingExpr)
-				groupOperations.projectionExprs = append(groupOperations.projectionExprs, fnc)
-			} else if op.Type() == ExpressionOrdering {
-				orderOperations = append(orderOperations, op.(*OrderingExpr))
-				if len(orderOperations) > MaxOrderingExprCount {
-					return nil, fmt.Errorf("too many ordering expressions, maximum is %d", MaxOrderingExprCount)
+				order := &orderStage{
+					input: rows,
+					cmp: &rowComparator{
+						ctx:             ctx,
+						orderOperations: orderOperations,
+					},
+					limit:   limit,
+					options: &options,
+					step:    stepIdx + 1,
+				}
+				cleanup = append(cleanup, order.close)
+				rows = order
+			}
+			if len(limitOperations) > 0 {
+				rows = &limitStage{
+					input:  rows,
+					limit:  limitOperations[0].limit,
+					offset: limitOperations[0].offset,
 				}
-			} else if op.Type() == ExpressionLimit {
-				limitOperations = append(limitOperations, op.(*LimitExpr))
-				if len(limitOperations) > 1 {
-					return nil, fmt.Errorf("cannot have more than one limit expression in a line")
+			} else if step.tailExpr != nil {
+				rows = &tailStage{
+					input: rows,
+					n:     int(step.tailExpr.n),
 				}
+			} else if step.sampleExpr != nil {
+				rows = newSampleStage(rows, step.sampleExpr)
+			}
+		} else if step.distinctExpr != nil {
+			// The distinct stage has already been added above.
+		} else if len(step.windowExprs) > 0 {
+			rows = &windowStage{
+				input: rows,
+				ops:   ops,
+				step:  stepIdx + 1,
+			}
+		} else if options.Parallelism > 1 {
+			projection := newParallelProjectionStage(rows, ops, options.Parallelism, stepIdx+1)
+			cleanup = append(cleanup, projection.close)
+			rows = projection
+		} else {
+			rows = &projectionStage{
+				input: rows,
+				ops:   ops,
+				step:  stepIdx + 1,
 			}
 		}
+	}
 
-		for _, record := range resultSet {
-			projection := []Value{}
-			if groupOperations.groupExpr != nil || len(groupOperations.projectionExprs) > 0 {
-				groupString := ""
-				groupResults := []Value{}
-
-				if groupOperations.groupExpr != nil {
-					res, err := groupOperations.groupExpr.Execute(0, record)
-					if err != nil {
-						panic(err)
-					}
-					if res.value != nil {
-						groupString = res.value.String()
-						asList := res.value.value.([]Value)
-						groupingValues[groupString] = asList
-						groupResults = append(groupResults, asList...)
-					}
-				}
+	return writeResult(rows, options, sink)
+}
+
+// schemaSampleRows is how many rows of the result are buffered to infer the
+// schema before the rows are streamed to the sink.
+const schemaSampleRows = 1000
+
+func writeResult(rows rowIterator, options Options, sink ResultSink) error {
+	sample := [][]Value{}
+	done := false
+	for len(sample) < schemaSampleRows {
+		row, err := rows.Next()
+		if err == io.EOF {
+			done = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sample = append(sample, row)
+	}
+
+	schema := inferSchema(sample)
+	if options.PrintTypes {
+		valueTypes := make([]ValueType, len(schema))
+		for i, c := range schema {
+			valueTypes[i] = c.Type
+		}
+		fmt.Println(valueTypes)
+	}
+
+	if err := sink.Begin(schema); err != nil {
+		return err
+	}
+	for _, r := range sample {
+		if err := sink.WriteRow(r); err != nil {
+			return err
+		}
+	}
+	for !done {
+		row, err := rows.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := sink.WriteRow(row); err != nil {
+			return err
+		}
+	}
+	return sink.End()
+}
+
+// isFilter returns true if the result of an operation is used to filter rows
+// rather than being projected. Boolean results are filters, except for
+// functions like if() that are used to compute values.
+func isFilter(op Expression, res *Value) bool {
+	switch op := op.(type) {
+	case *WhereExpr:
+		return true
+	case *KeepExpr:
+		return false
+	case *Funcall:
+		if op.projectsBool() {
+			return false
+		}
+	}
+	return res.typ == ValueTypeBool
+}
+
+// writeOps writes the operations of each step and their roles, as printed
+// by -ops.
+func writeOps(w io.Writer, operations [][]Expression) error {
+	for stepIdx, ops := range operations {
+		if _, err := fmt.Fprintf(w, "step %d:\n", stepIdx+1); err != nil {
+			return err
+		}
+		for i, op := range ops {
+			if _, err := fmt.Fprintf(w, "  %d %v: %v\n", i, slotRole(op), op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// opRole is what an operation does in its step.
+type opRole int
+
+const (
+	// roleProjectionOrFilter is the role of an operation whose result type
+	// is only known when the query runs. It filters if the result is a bool
+	// and projects otherwise.
+	roleProjectionOrFilter opRole = iota
+	roleFilter
+	roleProjection
+	roleGrouping
+	roleAggregation
+	roleOrdering
+	roleLimit
+	roleDistinct
+	roleWindow
+	roleJoin
+	rolePivot
+	roleLet
+)
 
-				for i, op := range groupOperations.projectionExprs {
-					res, err := op.argument.Execute(i, record)
-					if err != nil {
-						panic(err)
-					}
-					if res.value != nil {
-						groupResults = append(groupResults, *res.value)
-					}
+var opRoleNames = [...]string{
+	roleProjectionOrFilter: "projection, or filter if boolean",
+	roleFilter:             "filter",
+	roleProjection:         "projection",
+	roleGrouping:           "grouping",
+	roleAggregation:        "aggregation",
+	roleOrdering:           "ordering",
+	roleLimit:              "limit",
+	roleDistinct:           "distinct",
+	roleWindow:             "window",
+	roleJoin:               "join",
+	rolePivot:              "pivot",
+	roleLet:                "let",
+}
+
+// String returns the role as printed by -ops and -explain.
+func (r opRole) String() string {
+	return opRoleNames[r]
+}
+
+// slotRole returns what an operation does in its step.
+func slotRole(op Expression) opRole {
+	switch op := op.(type) {
+	case *WhereExpr:
+		return roleFilter
+	case *KeepExpr:
+		return roleProjection
+	case *OpEquals, *OpLt, *OpGt, *OpNeg:
+		return roleFilter
+	case *Funcall:
+		if op.projectsBool() {
+			return roleProjection
+		}
+		if fn, ok := op.resolved(); ok && fn.returnType == ValueTypeBool {
+			return roleFilter
+		}
+	case *GroupingExpr:
+		return roleGrouping
+	case *AggregatingExpr:
+		return roleAggregation
+	case *OrderingExpr:
+		return roleOrdering
+	case *LimitExpr, *TailExpr, *SampleExpr:
+		return roleLimit
+	case *DistinctExpr:
+		return roleDistinct
+	case *WindowExpr:
+		return roleWindow
+	case *JoinExpr:
+		return roleJoin
+	case *PivotExpr, *UnpivotExpr:
+		return rolePivot
+	case *LetExpr:
+		return roleLet
+	case *LiteralExpression:
+		if op.value.typ == ValueTypeBool {
+			return roleFilter
+		}
+		return roleProjection
+	}
+	return roleProjectionOrFilter
+}
+
+// rowError adds the step and the row in the input of the step that caused an
+// error to the error. Both are counted from 1.
+func rowError(step, row int, err error) error {
+	return fmt.Errorf("step %d, row %d: %w", step, row, err)
+}
+
+func isLimitStep(ops []Expression) bool {
+	return len(ops) == 1 && ops[0].Type() == ExpressionLimit
+}
+
+// rowIterator is a stage in the pipeline of a query. Next returns io.EOF when
+// there are no more rows.
+type rowIterator interface {
+	Next() ([]Value, error)
+}
+
+type csvSource struct {
+	ctx     context.Context
+	reader  *csv.Reader
+	options *Options
+	read    int
+	emitted int
+	// parseFields is false when the fields are parsed by a later stage, in
+	// which case the fields are returned as strings.
+	parseFields bool
+}
+
+func newCSVSource(ctx context.Context, reader io.Reader, options Options) (*csvSource, error) {
+	csvReader := csv.NewReader(reader)
+	sep, _ := utf8.DecodeRuneInString(options.Separator)
+	if sep == utf8.RuneError {
+		return nil, fmt.Errorf("invalid separator: %q", options.Separator)
+	}
+	csvReader.Comma = sep
+	csvReader.FieldsPerRecord = -1
+	csvReader.ReuseRecord = true
+	return &csvSource{
+		ctx:         ctx,
+		reader:      csvReader,
+		options:     &options,
+		parseFields: true,
+	}, nil
+}
+
+func (s *csvSource) Next() ([]Value, error) {
+	for {
+		if s.read%contextCheckInterval == 0 {
+			if err := s.ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		r, err := s.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		s.read++
+		if s.read <= s.options.Skip {
+			continue
+		}
+		if s.options.MaxInputRows > 0 && s.emitted >= s.options.MaxInputRows {
+			err := s.options.limitExceeded(&LimitError{Kind: LimitInputRows, Max: s.options.MaxInputRows})
+			if err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		s.emitted++
+		record := make([]Value, len(r))
+		for j, v := range r {
+			if !s.parseFields {
+				record[j] = Value{
+					typ:   ValueTypeString,
+					value: v,
 				}
+				continue
+			}
+			literalExpr := parseLiteral(v)
+			record[j] = literalExpr.value
+		}
+		return record, nil
+	}
+}
+
+type sliceIterator struct {
+	rows [][]Value
+	pos  int
+}
 
-				if existing, ok := groupedResults[groupString]; ok {
-					startIndex := 0
-					if l, ok := groupingValues[groupString]; ok {
-						startIndex = len(l)
-					}
-					for i, v := range existing[startIndex:] {
-						next := groupResults[i+startIndex]
-						aggr := groupOperations.projectionExprs[i]
-						aggrFn, ok := aggregationFuncMap[aggr.aggregationName]
-						if !ok {
-							panic("aggregation function '" + aggr.aggregationName + "' not found")
-						}
-						va, err := v.Convert(aggrFn.valueType)
-						if err != nil {
-							return nil, err
-						}
-						vb, err := next.Convert(aggrFn.valueType)
-						if err != nil {
-							return nil, err
-						}
-						vr, err := aggrFn.fn(*va, *vb)
-						if err != nil {
-							return nil, err
-						}
-						existing[i+startIndex] = *vr
-					}
-				} else {
-					groupedResults[groupString] = groupResults
+func (s *sliceIterator) Next() ([]Value, error) {
+	if s.pos >= len(s.rows) {
+		return nil, io.EOF
+	}
+	row := s.rows[s.pos]
+	s.pos++
+	return row, nil
+}
+
+type projectionStage struct {
+	input rowIterator
+	ops   []Expression
+	step  int
+	read  int
+}
+
+func (s *projectionStage) Next() ([]Value, error) {
+	for {
+		record, err := s.input.Next()
+		if err != nil {
+			return nil, err
+		}
+		s.read++
+		row, ok, err := project(s.ops, record)
+		if err != nil {
+			return nil, rowError(s.step, s.read, err)
+		}
+		if ok {
+			return row, nil
+		}
+	}
+}
+
+// project applies the filters and projections of a step to a record. It
+// returns false if the record was excluded by a filter.
+func project(ops []Expression, record []Value) ([]Value, bool, error) {
+	projection := []Value{}
+	for i, op := range ops {
+		res, err := op.Execute(i, record)
+		if err != nil {
+			return nil, false, err
+		}
+		if res.value != nil {
+			if isFilter(op, res.value) {
+				if !res.value.value.(bool) {
+					return nil, false, nil
 				}
-			} else if len(orderOperations) > 0 || len(limitOperations) > 0 {
-				nextResultSet = append(nextResultSet, record)
 			} else {
-				excluded := false
-				for i, op := range ops {
-					res, err := op.Execute(i, record)
-					if err != nil {
-						panic(err)
-					}
-					if res.value != nil {
-						if res.value.typ == ValueTypeBool {
-							if !res.value.value.(bool) {
-								excluded = true
-								break
-							}
-						} else {
-							projection = append(projection, *res.value)
-						}
-					}
-				}
-				if !excluded {
-					if len(projection) > 0 {
-						nextResultSet = append(nextResultSet, projection)
-					} else {
-						nextResultSet = append(nextResultSet, record)
-					}
-				}
+				projection = expandResult(projection, op, res.value)
 			}
 		}
-		if len(groupedResults) > 0 {
-			for _, gr := range groupedResults {
-				nextResultSet = append(nextResultSet, gr)
-			}
-		}
-		if len(orderOperations) > 0 {
-			slices.SortFunc(nextResultSet, func(iv, jv []Value) int {
-				var sortValueI int64 = 0
-				var sortValueJ int64 = 0
-				for i, op := range orderOperations {
-					resI, err := op.argument.Execute(i, iv)
-					if err != nil {
-						panic(err)
-					}
-					resJ, err := op.argument.Execute(i, jv)
-					if err != nil {
-						panic(err)
-					}
-					if resI.value == nil || resJ.value == nil {
-						continue
-					}
-
-					eq := OpEquals{
-						lhs: &LiteralExpression{
-							value: *resI.value,
-						},
-						rhs: &LiteralExpression{
-							value: *resJ.value,
-						},
-					}
-					eqRes, err := eq.Execute(0, nil)
-					if err != nil {
-						panic(err)
-					}
-					if eqRes.value.value.(bool) {
-						continue
-					}
-
-					lt := OpLt{
-						lhs: &LiteralExpression{
-							value: *resI.value,
-						},
-						rhs: &LiteralExpression{
-							value: *resJ.value,
-						},
-					}
-
-					ltRes, err := lt.Execute(0, nil)
-					if err != nil {
-						panic(err)
-					}
-
-					if op.direction == OrderDirectionAsc {
-						if !ltRes.value.value.(bool) {
-							sortValueI += powInt64(10, MaxOrderingExprCount-int64(i)+1)
-						} else {
-							sortValueJ += powInt64(10, MaxOrderingExprCount-int64(i)+1)
-						}
-					} else {
-						if ltRes.value.value.(bool) {
-							sortValueI += powInt64(10, MaxOrderingExprCount-int64(i)+1)
-						} else {
-							sortValueJ += powInt64(10, MaxOrderingExprCount-int64(i)+1)
-						}
-					}
+	}
+	if len(projection) > 0 {
+		return projection, true, nil
+	}
+	return record, true, nil
+}
+
+type groupStage struct {
+	input           rowIterator
+	groupOperations GroupOperations
+	options         *Options
+	step            int
+	output          *sliceIterator
+}
+
+func (s *groupStage) Next() ([]Value, error) {
+	if s.output == nil {
+		var rows [][]Value
+		var err error
+		if s.options.Parallelism > 1 {
+			rows, err = s.aggregateParallel(s.options.Parallelism)
+		} else {
+			rows, err = s.aggregate()
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.output = &sliceIterator{rows: rows}
+	}
+	return s.output.Next()
+}
+
+func (s *groupStage) aggregate() ([][]Value, error) {
+	acc := newGroupAccumulator(s.groupOperations)
+	groupLimitHit := false
+	for seq := 0; ; seq++ {
+		record, err := s.input.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		row, err := evaluateGroupRow(s.groupOperations, record)
+		if err != nil {
+			return nil, rowError(s.step, seq+1, err)
+		}
+		if _, ok := acc.groupedResults[row.key]; !ok && s.options.MaxGroups > 0 && len(acc.groupedResults) >= s.options.MaxGroups {
+			if !groupLimitHit {
+				groupLimitHit = true
+				err := s.options.limitExceeded(&LimitError{Kind: LimitGroups, Max: s.options.MaxGroups, Step: s.step})
+				if err != nil {
+					return nil, err
 				}
-				return int(sortValueI - sortValueJ)
+			}
+			continue
+		}
+		if err := acc.add(seq, row); err != nil {
+			return nil, err
+		}
+	}
+	return mergeGroups(acc), nil
+}
+
+// groupRow is a record with the grouping and aggregating expressions of a step
+// evaluated, ready to be added to a groupAccumulator.
+type groupRow struct {
+	key          string
+	groupValues  []Value
+	groupResults []Value
+}
+
+func evaluateGroupRow(groupOperations GroupOperations, record []Value) (groupRow, error) {
+	row := groupRow{}
+	if groupOperations.groupExpr != nil {
+		res, err := groupOperations.groupExpr.Execute(0, record)
+		if err != nil {
+			return row, err
+		}
+		if res.value != nil {
+			row.key = res.value.String()
+			row.groupValues = res.value.value.([]Value)
+			row.groupResults = append(row.groupResults, row.groupValues...)
+		}
+	}
+
+	for i, op := range groupOperations.projectionExprs {
+		res, err := op.argument.Execute(i, record)
+		if err != nil {
+			return row, err
+		}
+		if res.value != nil {
+			row.groupResults = append(row.groupResults, *res.value)
+		}
+	}
+	return row, nil
+}
+
+type groupAccumulator struct {
+	groupOperations GroupOperations
+	groupingValues  map[string][]Value
+	groupedResults  map[string][]Value
+	firstSeen       map[string]int
+}
+
+func newGroupAccumulator(groupOperations GroupOperations) *groupAccumulator {
+	return &groupAccumulator{
+		groupOperations: groupOperations,
+		groupingValues:  map[string][]Value{},
+		groupedResults:  map[string][]Value{},
+		firstSeen:       map[string]int{},
+	}
+}
+
+func (a *groupAccumulator) add(seq int, row groupRow) error {
+	existing, ok := a.groupedResults[row.key]
+	if !ok {
+		a.groupingValues[row.key] = row.groupValues
+		a.groupedResults[row.key] = row.groupResults
+		a.firstSeen[row.key] = seq
+		return nil
+	}
+	startIndex := len(a.groupingValues[row.key])
+	for i, v := range existing[startIndex:] {
+		next := row.groupResults[i+startIndex]
+		aggr := a.groupOperations.projectionExprs[i]
+		aggrFn, _ := aggr.resolved()
+		va, err := v.Convert(aggrFn.valueType)
+		if err != nil {
+			return err
+		}
+		vb, err := next.Convert(aggrFn.valueType)
+		if err != nil {
+			return err
+		}
+		vr, err := aggrFn.fn(*va, *vb)
+		if err != nil {
+			return err
+		}
+		existing[i+startIndex] = *vr
+	}
+	return nil
+}
+
+// mergeGroups returns the groups of all accumulators in the order they were
+// first seen in the input.
+func mergeGroups(accumulators ...*groupAccumulator) [][]Value {
+	type group struct {
+		firstSeen int
+		row       []Value
+	}
+	groups := []group{}
+	for _, acc := range accumulators {
+		for key, row := range acc.groupedResults {
+			groups = append(groups, group{
+				firstSeen: acc.firstSeen[key],
+				row:       row,
 			})
 		}
-		if len(limitOperations) > 0 {
-			limit := limitOperations[0].limit
-			if limit < 0 {
-				return nil, fmt.Errorf("limit cannot be negative")
+	}
+	slices.SortFunc(groups, func(a, b group) int {
+		return cmp.Compare(a.firstSeen, b.firstSeen)
+	})
+	rows := make([][]Value, len(groups))
+	for i, g := range groups {
+		rows[i] = g.row
+	}
+	return rows
+}
+
+// distinctStage streams the first row for each distinct key and drops the
+// rest, so the rows keep the order they were first seen in.
+type distinctStage struct {
+	input        rowIterator
+	distinctExpr *DistinctExpr
+	seen         map[string]struct{}
+	step         int
+	read         int
+}
+
+func (s *distinctStage) Next() ([]Value, error) {
+	for {
+		record, err := s.input.Next()
+		if err != nil {
+			return nil, err
+		}
+		s.read++
+		res, err := s.distinctExpr.Execute(0, record)
+		if err != nil {
+			return nil, rowError(s.step, s.read, err)
+		}
+		key := rowKey(res.value.value.([]Value))
+		if _, ok := s.seen[key]; ok {
+			continue
+		}
+		s.seen[key] = struct{}{}
+		return record, nil
+	}
+}
+
+// rowKey encodes values as a string which is only equal for equal values. The
+// type and length of each value is included so that e.g. the int 1 and the
+// string "1", or the rows "a,b" and "a","b" do not collide.
+func rowKey(values []Value) string {
+	b := strings.Builder{}
+	for _, v := range values {
+		str := v.String()
+		b.WriteByte(byte(v.typ))
+		b.WriteString(strconv.Itoa(len(str)))
+		b.WriteByte(':')
+		b.WriteString(str)
+	}
+	return b.String()
+}
+
+type orderStage struct {
+	input   rowIterator
+	cmp     *rowComparator
+	limit   *LimitExpr
+	options *Options
+	step    int
+	output  rowIterator
+	sorter  *externalSorter
+}
+
+func (s *orderStage) Next() ([]Value, error) {
+	if s.output == nil {
+		output, err := s.sort()
+		if err != nil {
+			return nil, err
+		}
+		s.output = output
+	}
+	row, err := s.output.Next()
+	if err == nil && s.cmp.err != nil {
+		return nil, s.cmp.err
+	}
+	return row, err
+}
+
+func (s *orderStage) sort() (rowIterator, error) {
+	if s.limit != nil && s.limit.limit >= 0 && s.limit.offset >= 0 {
+		// The offset is skipped by the limit stage that follows, so the rows
+		// before it must be kept as well.
+		topN := newTopNSorter(s.cmp, int(s.limit.limit+s.limit.offset))
+		for {
+			record, err := s.input.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := topN.add(record); err != nil {
+				return nil, err
 			}
-			nextResultSet = nextResultSet[:limit]
 		}
-		resultSet = nextResultSet
+		return topN.iterator()
 	}
 
-	valueTypes := []ValueType{}
-	resultSetStrings := make([][]string, len(resultSet))
-	for i, r := range resultSet {
-		resultSetStrings[i] = make([]string, len(r))
-		for j, v := range r {
-			if j >= len(valueTypes) {
-				valueTypes = append(valueTypes, v.typ)
-			} else {
-				if valueTypes[j] != v.typ {
-					valueTypes[j] = ValueTypeUnknown
-				}
+	s.sorter = &externalSorter{
+		cmp:        s.cmp,
+		memoryRows: s.options.SortMemoryRows,
+		tempDir:    s.options.TempDir,
+	}
+	rowCount := 0
+	for {
+		record, err := s.input.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if s.options.MaxOrderRows > 0 && rowCount >= s.options.MaxOrderRows {
+			err := s.options.limitExceeded(&LimitError{Kind: LimitOrderRows, Max: s.options.MaxOrderRows, Step: s.step})
+			if err != nil {
+				return nil, err
 			}
-			resultSetStrings[i][j] = v.String()
+			break
+		}
+		rowCount++
+		if err := s.sorter.add(record); err != nil {
+			return nil, err
 		}
 	}
+	return s.sorter.iterator()
+}
 
-	if options.PrintTypes {
-		fmt.Println(valueTypes)
+func (s *orderStage) close() {
+	if s.sorter != nil {
+		s.sorter.close()
+	}
+}
+
+type limitStage struct {
+	input   rowIterator
+	limit   int64
+	offset  int64
+	skipped int64
+	emitted int64
+}
+
+func (s *limitStage) Next() ([]Value, error) {
+	if s.limit < 0 || s.offset < 0 {
+		return nil, fmt.Errorf("limit cannot be negative")
+	}
+	for s.skipped < s.offset {
+		if _, err := s.input.Next(); err != nil {
+			return nil, err
+		}
+		s.skipped++
+	}
+	if s.emitted >= s.limit {
+		return nil, io.EOF
+	}
+	row, err := s.input.Next()
+	if err != nil {
+		return nil, err
+	}
+	s.emitted++
+	return row, nil
+}
+
+// tailStage keeps the last n rows of its input in a ring buffer.
+type tailStage struct {
+	input  rowIterator
+	n      int
+	output *sliceIterator
+}
+
+func (s *tailStage) Next() ([]Value, error) {
+	if s.output == nil {
+		// The ring grows up to n rows, so that a large n does not allocate
+		// more than the input needs.
+		ring := [][]Value{}
+		count := 0
+		for {
+			row, err := s.input.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(ring) < s.n {
+				ring = append(ring, row)
+			} else if s.n > 0 {
+				ring[count%s.n] = row
+			}
+			count++
+		}
+		rows := make([][]Value, 0, min(count, s.n))
+		for i := max(count-s.n, 0); i < count; i++ {
+			rows = append(rows, ring[i%s.n])
+		}
+		s.output = &sliceIterator{rows: rows}
 	}
+	return s.output.Next()
+}
 
-	return resultSetStrings, nil
+// sampleStage picks n random rows from its input using reservoir sampling.
+// The sampled rows are returned in the order they had in the input.
+type sampleStage struct {
+	input  rowIterator
+	n      int
+	rand   *rand.Rand
+	output *sliceIterator
 }
 
-func powInt64(base, exp int64) int64 {
-	if exp < 0 {
-		return 0
+func newSampleStage(input rowIterator, sampleExpr *SampleExpr) *sampleStage {
+	seed := time.Now().UnixNano()
+	if sampleExpr.seeded {
+		seed = sampleExpr.seed
+	}
+	return &sampleStage{
+		input: input,
+		n:     int(sampleExpr.n),
+		rand:  rand.New(rand.NewSource(seed)),
 	}
-	result := int64(1)
-	for i := int64(0); i < exp; i++ {
-		result *= base
+}
+
+func (s *sampleStage) Next() ([]Value, error) {
+	if s.output == nil {
+		type sampledRow struct {
+			seq int
+			row []Value
+		}
+		reservoir := []sampledRow{}
+		for seq := 0; ; seq++ {
+			row, err := s.input.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(reservoir) < s.n {
+				reservoir = append(reservoir, sampledRow{seq: seq, row: row})
+			} else if j := s.rand.Intn(seq + 1); j < s.n {
+				reservoir[j] = sampledRow{seq: seq, row: row}
+			}
+		}
+		slices.SortFunc(reservoir, func(a, b sampledRow) int {
+			return cmp.Compare(a.seq, b.seq)
+		})
+		rows := make([][]Value, len(reservoir))
+		for i, r := range reservoir {
+			rows[i] = r.row
+		}
+		s.output = &sliceIterator{rows: rows}
 	}
-	return result
+	return s.output.Next()
 }
@@ -0,0 +1,301 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Plan describes how each step of a query is run, as printed by -explain.
+// Types are only known if the plan was made with a sample of the input, and
+// are left out otherwise.
+type Plan struct {
+	Input []string    `json:"input,omitempty"`
+	Steps []*PlanStep `json:"steps"`
+}
+
+type PlanStep struct {
+	Step int `json:"step"`
+	// Kind is what the step does, such as projection, group or order.
+	Kind string `json:"kind"`
+	// Streaming is true if rows are passed on as they are read, and false
+	// if the step has to read rows before it can pass any on.
+	Streaming bool `json:"streaming"`
+	// Buffers describes what the step holds in memory, if anything.
+	Buffers    string           `json:"buffers,omitempty"`
+	Operations []*PlanOperation `json:"operations"`
+	Output     []string         `json:"output,omitempty"`
+}
+
+type PlanOperation struct {
+	// Role is what the operation does in its step, such as filter,
+	// projection, group key, aggregate or sort key.
+	Role string `json:"role"`
+	// Expr is the operation with implicit column references written out.
+	Expr string `json:"expr"`
+	Type string `json:"type,omitempty"`
+	// Implicit are the column references that were filled in implicitly.
+	Implicit []string `json:"implicit,omitempty"`
+}
+
+// Explain returns the plan of the query. If source is not nil, the types of
+// the columns are inferred from the first rows of it.
+func (q *Query) Explain(source io.Reader) (*Plan, error) {
+	plan := &Plan{}
+	var schema []ValueType
+	if source != nil {
+		csvSource, err := newCSVSource(context.Background(), source, q.options)
+		if err != nil {
+			return nil, err
+		}
+		sample, _, err := sampleRows(csvSource, schemaSampleRows)
+		if err != nil {
+			return nil, err
+		}
+		// Without any rows, nothing is known about the columns.
+		if len(sample) > 0 {
+			schema = []ValueType{}
+			for _, c := range inferSchema(sample) {
+				schema = append(schema, c.Type)
+			}
+			plan.Input = typeNames(schema)
+		}
+	}
+	for stepIdx := range q.steps {
+		step, next, err := explainStep(q.steps, stepIdx, schema)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", stepIdx+1, err)
+		}
+		if next != nil {
+			step.Output = typeNames(next)
+		}
+		plan.Steps = append(plan.Steps, step)
+		schema = next
+	}
+	return plan, nil
+}
+
+// explainStep returns the plan of a step and the types of its output, which
+// are nil if they cannot be known.
+func explainStep(operations [][]Expression, stepIdx int, schema []ValueType) (*PlanStep, []ValueType, error) {
+	ops := operations[stepIdx]
+	step, err := classifyStep(ops)
+	if err != nil {
+		return nil, nil, err
+	}
+	plan := &PlanStep{
+		Step:       stepIdx + 1,
+		Streaming:  true,
+		Operations: []*PlanOperation{},
+	}
+	add := func(role string, e Expression, expr string, p *printer) {
+		op := &PlanOperation{
+			Role: role,
+			Expr: expr,
+		}
+		if schema != nil && e != nil {
+			op.Type = typeName(explainType(e, schema))
+		}
+		for _, idx := range p.implicit {
+			ref := "$" + strconv.Itoa(idx)
+			if !slices.Contains(op.Implicit, ref) {
+				op.Implicit = append(op.Implicit, ref)
+			}
+		}
+		plan.Operations = append(plan.Operations, op)
+	}
+	for _, op := range ops {
+		p := &printer{explicit: true}
+		switch op := op.(type) {
+		case *Nop:
+		case *GroupingExpr:
+			for _, key := range op.arguments.exprs {
+				p := &printer{explicit: true}
+				add("group key", key, p.expr(key), p)
+			}
+		case *AggregatingExpr:
+			add("aggregate", op, p.expr(op), p)
+		case *OrderingExpr:
+			add("sort key", op.argument, p.expr(op.argument)+orderOptions(op, " "), p)
+		case *LimitExpr:
+			expr := strconv.FormatInt(op.limit, 10)
+			if op.offset != 0 {
+				expr += fmt.Sprintf(" offset %d", op.offset)
+			}
+			add("limit", nil, expr, p)
+		case *TailExpr:
+			add("tail", nil, strconv.FormatInt(op.n, 10), p)
+		case *SampleExpr:
+			expr := strconv.FormatInt(op.n, 10)
+			if op.seeded {
+				expr += fmt.Sprintf(" seed %d", op.seed)
+			}
+			add("sample", nil, expr, p)
+		case *DistinctExpr:
+			expr := p.list(op.arguments.exprs...)
+			if expr == "" {
+				expr = "all columns"
+			}
+			add("distinct", nil, expr, p)
+		case *LetExpr:
+			add("let", op.value, fmt.Sprintf(":%v = %v", op.name, p.expr(op.value)), p)
+		case *JoinExpr, *PivotExpr, *UnpivotExpr:
+			add(slotRole(op).String(), nil, p.operation(op), p)
+		default:
+			role := slotRole(op)
+			if role == roleProjectionOrFilter && schema != nil {
+				if typ, err := inferType(op, schema); err == nil && typ != ValueTypeUnknown {
+					role = roleProjection
+					if isFilter(op, &Value{typ: typ}) {
+						role = roleFilter
+					}
+				}
+			}
+			add(role.String(), op, p.operation(op), p)
+		}
+	}
+
+	groupOperations := step.groupOperations
+	switch {
+	case step.letExpr != nil:
+		plan.Kind = "let"
+	case step.joinExpr != nil:
+		plan.Kind = "join"
+		plan.Buffers = "the joined file"
+	case step.pivotExpr != nil:
+		plan.Kind = "pivot"
+		plan.Streaming = false
+		plan.Buffers = "one row per row key"
+	case step.unpivotExpr != nil:
+		plan.Kind = "unpivot"
+	case groupOperations.groupExpr != nil || len(groupOperations.projectionExprs) > 0:
+		plan.Kind = "group"
+		plan.Streaming = false
+		plan.Buffers = "one row per group"
+		if groupOperations.groupExpr == nil {
+			plan.Buffers = "one row"
+		}
+	case len(step.orderOperations) > 0:
+		plan.Kind = "order"
+		plan.Streaming = false
+		plan.Buffers = "all rows"
+		limit := (*LimitExpr)(nil)
+		if len(step.limitOperations) > 0 {
+			limit = step.limitOperations[0]
+		} else if !step.hasRowLimit() && stepIdx+1 < len(operations) && isLimitStep(operations[stepIdx+1]) {
+			limit = operations[stepIdx+1][0].(*LimitExpr)
+		}
+		if limit != nil {
+			plan.Buffers = fmt.Sprintf("the first %d rows", limit.limit+limit.offset)
+		}
+	case len(step.limitOperations) > 0:
+		plan.Kind = "limit"
+	case step.tailExpr != nil:
+		plan.Kind = "tail"
+		plan.Streaming = false
+		plan.Buffers = fmt.Sprintf("the last %d rows", step.tailExpr.n)
+	case step.sampleExpr != nil:
+		plan.Kind = "sample"
+		plan.Streaming = false
+		plan.Buffers = fmt.Sprintf("%d rows", step.sampleExpr.n)
+	case step.distinctExpr != nil:
+		plan.Kind = "distinct"
+		plan.Buffers = "one key per distinct row"
+	case len(step.windowExprs) > 0:
+		plan.Kind = "window"
+		plan.Streaming = false
+		plan.Buffers = "all rows"
+	default:
+		plan.Kind = "projection"
+	}
+
+	var next []ValueType
+	if schema != nil {
+		next, err = typeCheckStep(ops, schema)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return plan, next, nil
+}
+
+// explainType returns the type of the result of an operation, or
+// ValueTypeUnknown if it cannot be known.
+func explainType(e Expression, schema []ValueType) ValueType {
+	if aggr, ok := e.(*AggregatingExpr); ok {
+		if fn, ok := aggr.resolved(); ok {
+			return fn.valueType
+		}
+	}
+	if let, ok := e.(*LetExpr); ok {
+		e = let.value
+	}
+	typ, err := inferType(e, schema)
+	if err != nil {
+		return ValueTypeUnknown
+	}
+	return typ
+}
+
+func typeNames(types []ValueType) []string {
+	res := make([]string, len(types))
+	for i, typ := range types {
+		res[i] = typeName(typ)
+	}
+	return res
+}
+
+// WriteText writes the plan in the format printed by -explain.
+func (p *Plan) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if p.Input != nil {
+		fmt.Fprintf(tw, "input: %v\n", strings.Join(p.Input, ", "))
+	}
+	for _, step := range p.Steps {
+		mode := "streaming"
+		if !step.Streaming {
+			mode = "buffering"
+		}
+		if step.Buffers != "" {
+			mode += ", holds " + step.Buffers
+		}
+		if step.Kind == "let" {
+			mode = "run once"
+		}
+		fmt.Fprintf(tw, "step %d: %v (%v)\n", step.Step, step.Kind, mode)
+		for _, op := range step.Operations {
+			cells := []string{op.Role, op.Expr}
+			if op.Type != "" {
+				cells = append(cells, op.Type)
+			}
+			if len(op.Implicit) > 0 {
+				cells = append(cells, "implicit "+strings.Join(op.Implicit, ", "))
+			}
+			fmt.Fprintf(tw, "  %v\n", strings.Join(cells, "\t"))
+		}
+		if step.Output != nil {
+			fmt.Fprintf(tw, "  output: %v\n", strings.Join(step.Output, ", "))
+		}
+	}
+	return tw.Flush()
+}
@@ -20,6 +20,7 @@ package csql
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -40,6 +41,18 @@ const (
 	ExpressionAggregating
 	ExpressionOrdering
 	ExpressionLimit
+	ExpressionDistinct
+	ExpressionTail
+	ExpressionSample
+	ExpressionWindow
+	ExpressionJoin
+	ExpressionColumnRange
+	ExpressionPivot
+	ExpressionUnpivot
+	ExpressionWhere
+	ExpressionKeep
+	ExpressionParameter
+	ExpressionLet
 )
 
 type ValueType int
@@ -59,47 +72,64 @@ type Value struct {
 	value any
 }
 
+// Convert converts a value to another type. Dates are converted to and from
+// numbers as seconds since the Unix epoch. Null values stay null.
 func (v *Value) Convert(targetType ValueType) (*Value, error) {
-	if targetType == v.typ {
+	if targetType == v.typ || v.IsNull() {
 		return v, nil
 	}
-	if targetType == ValueTypeString {
+	if v.typ == ValueTypeList || targetType == ValueTypeList || targetType == ValueTypeUnknown {
+		return nil, conversionError(v.typ, targetType)
+	}
+	switch targetType {
+	case ValueTypeString:
 		return &Value{
 			typ:   ValueTypeString,
 			value: v.String(),
 		}, nil
-	} else if targetType == ValueTypeBool {
-		if v.typ == ValueTypeString {
-			str := v.value.(string)
-			if str == "true" {
-				return &Value{
-					typ:   ValueTypeBool,
-					value: true,
-				}, nil
-			} else if str == "false" {
-				return &Value{
-					typ:   ValueTypeBool,
-					value: false,
-				}, nil
+	case ValueTypeBool:
+		switch v.typ {
+		case ValueTypeString:
+			b, err := strconv.ParseBool(v.value.(string))
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert %q to bool", v.value)
 			}
-		} else if v.typ == ValueTypeInt {
-			i := v.value.(int64)
 			return &Value{
 				typ:   ValueTypeBool,
-				value: i != 0,
+				value: b,
+			}, nil
+		case ValueTypeInt:
+			return &Value{
+				typ:   ValueTypeBool,
+				value: v.value.(int64) != 0,
+			}, nil
+		case ValueTypeDouble:
+			return &Value{
+				typ:   ValueTypeBool,
+				value: v.value.(float64) != 0,
 			}, nil
 		}
-	} else if targetType == ValueTypeInt {
-		if v.typ == ValueTypeString {
-			i, err := strconv.ParseInt(v.value.(string), 10, 64)
-			if err == nil {
+	case ValueTypeInt:
+		switch v.typ {
+		case ValueTypeString:
+			str := v.value.(string)
+			if i, err := strconv.ParseInt(str, 10, 64); err == nil {
 				return &Value{
 					typ:   ValueTypeInt,
 					value: i,
 				}, nil
 			}
-		} else if v.typ == ValueTypeBool {
-			i := 0
+			// Strings like 1e3 are integers too, but a string with a fraction
+			// is not silently truncated.
+			if d, err := strconv.ParseFloat(str, 64); err == nil && d == math.Trunc(d) && inInt64Range(d) {
+				return &Value{
+					typ:   ValueTypeInt,
+					value: int64(d),
+				}, nil
+			}
+			return nil, fmt.Errorf("cannot convert %q to int", str)
+		case ValueTypeBool:
+			i := int64(0)
 			if v.value.(bool) {
 				i = 1
 			}
@@ -107,44 +137,200 @@ func (v *Value) Convert(targetType ValueType) (*Value, error) {
 				typ:   ValueTypeInt,
 				value: i,
 			}, nil
-		} else if v.typ == ValueTypeDouble {
-			i := int64(v.value.(float64))
+		case ValueTypeDouble:
+			d := v.value.(float64)
+			if !inInt64Range(d) {
+				return nil, fmt.Errorf("cannot convert %v to int", d)
+			}
 			return &Value{
 				typ:   ValueTypeInt,
-				value: i,
+				value: int64(d),
+			}, nil
+		case ValueTypeDate:
+			return &Value{
+				typ:   ValueTypeInt,
+				value: v.value.(time.Time).Unix(),
 			}, nil
 		}
-	} else if targetType == ValueTypeDouble {
-		if v.typ == ValueTypeString {
+	case ValueTypeDouble:
+		switch v.typ {
+		case ValueTypeString:
 			d, err := strconv.ParseFloat(v.value.(string), 64)
-			if err == nil {
-				return &Value{
-					typ:   ValueTypeDouble,
-					value: d,
-				}, nil
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert %q to double", v.value)
 			}
-		} else if v.typ == ValueTypeInt {
-			d := float64(v.value.(int64))
 			return &Value{
 				typ:   ValueTypeDouble,
 				value: d,
 			}, nil
+		case ValueTypeBool:
+			d := 0.0
+			if v.value.(bool) {
+				d = 1
+			}
+			return &Value{
+				typ:   ValueTypeDouble,
+				value: d,
+			}, nil
+		case ValueTypeInt:
+			return &Value{
+				typ:   ValueTypeDouble,
+				value: float64(v.value.(int64)),
+			}, nil
+		case ValueTypeDate:
+			t := v.value.(time.Time)
+			return &Value{
+				typ:   ValueTypeDouble,
+				value: float64(t.UnixNano()) / float64(time.Second),
+			}, nil
 		}
-	} else if targetType == ValueTypeDate {
-		if v.typ == ValueTypeString {
+	case ValueTypeDate:
+		switch v.typ {
+		case ValueTypeString:
 			t, err := dateparse.ParseAny(v.value.(string))
-			if err == nil {
-				return &Value{
-					typ:   ValueTypeDate,
-					value: t,
-				}, nil
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert %q to date", v.value)
 			}
+			return &Value{
+				typ:   ValueTypeDate,
+				value: t,
+			}, nil
+		case ValueTypeInt:
+			return &Value{
+				typ:   ValueTypeDate,
+				value: time.Unix(v.value.(int64), 0).UTC(),
+			}, nil
+		case ValueTypeDouble:
+			d := v.value.(float64)
+			sec, frac := math.Modf(d)
+			return &Value{
+				typ:   ValueTypeDate,
+				value: time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC(),
+			}, nil
 		}
 	}
-	return nil, fmt.Errorf("unhandled conversion from type: %v to targetType: %v", v.typ, targetType)
+	return nil, conversionError(v.typ, targetType)
+}
+
+// canConvert returns true if values of one type can be converted to another,
+// at least for some values. Strings can only be converted if they can be
+// parsed as the other type.
+func canConvert(from, to ValueType) bool {
+	if from == to || from == ValueTypeUnknown || to == ValueTypeString {
+		return true
+	}
+	if from == ValueTypeList || to == ValueTypeList || to == ValueTypeUnknown {
+		return false
+	}
+	if (from == ValueTypeDate && to == ValueTypeBool) || (from == ValueTypeBool && to == ValueTypeDate) {
+		return false
+	}
+	return true
+}
+
+func conversionError(from, to ValueType) error {
+	return fmt.Errorf("cannot convert %v to %v", typeName(from), typeName(to))
+}
+
+// typeName returns the name of a type as it is written in queries.
+func typeName(typ ValueType) string {
+	switch typ {
+	case ValueTypeString:
+		return "string"
+	case ValueTypeBool:
+		return "bool"
+	case ValueTypeInt:
+		return "int"
+	case ValueTypeDouble:
+		return "double"
+	case ValueTypeDate:
+		return "date"
+	case ValueTypeList:
+		return "list"
+	}
+	return "unknown"
+}
+
+func (v *Value) Type() ValueType {
+	if v == nil {
+		return ValueTypeUnknown
+	}
+	return v.typ
+}
+
+func (v *Value) IsNull() bool {
+	return v == nil || v.value == nil
+}
+
+func (v *Value) Bool() (bool, bool) {
+	if v.IsNull() || v.typ != ValueTypeBool {
+		return false, false
+	}
+	return v.value.(bool), true
+}
+
+func (v *Value) Int() (int64, bool) {
+	if v.IsNull() || v.typ != ValueTypeInt {
+		return 0, false
+	}
+	return v.value.(int64), true
+}
+
+// Float returns the value as a float64. Integers are widened, so that callers
+// do not have to care whether a numeric column was parsed as an int.
+func (v *Value) Float() (float64, bool) {
+	if v.IsNull() {
+		return 0, false
+	}
+	if v.typ == ValueTypeDouble {
+		return v.value.(float64), true
+	} else if v.typ == ValueTypeInt {
+		return float64(v.value.(int64)), true
+	}
+	return 0, false
+}
+
+func (v *Value) Time() (time.Time, bool) {
+	if v.IsNull() || v.typ != ValueTypeDate {
+		return time.Time{}, false
+	}
+	return v.value.(time.Time), true
+}
+
+func (v *Value) Str() (string, bool) {
+	if v.IsNull() || v.typ != ValueTypeString {
+		return "", false
+	}
+	return v.value.(string), true
+}
+
+// The following functions create values, for example to return from
+// functions registered with an Engine. The zero Value is null.
+
+func BoolValue(b bool) Value {
+	return Value{typ: ValueTypeBool, value: b}
+}
+
+func IntValue(i int64) Value {
+	return Value{typ: ValueTypeInt, value: i}
+}
+
+func FloatValue(f float64) Value {
+	return Value{typ: ValueTypeDouble, value: f}
+}
+
+func TimeValue(t time.Time) Value {
+	return Value{typ: ValueTypeDate, value: t}
+}
+
+func StringValue(s string) Value {
+	return Value{typ: ValueTypeString, value: s}
 }
 
 func (v *Value) String() string {
+	if v.IsNull() {
+		return ""
+	}
 	if v.typ == ValueTypeBool {
 		if v.value.(bool) {
 			return "true"
@@ -190,3 +376,8 @@ type BinaryExpr interface {
 	SetLHS(e Expression)
 	SetRHS(e Expression)
 }
+
+// inInt64Range returns true if the integer part of d fits in an int64.
+func inInt64Range(d float64) bool {
+	return d >= math.MinInt64 && d < math.MaxInt64
+}
@@ -19,6 +19,7 @@ package csql
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 type FunctionType int
@@ -29,12 +30,24 @@ const (
 
 type Function struct {
 	argumentTypes []ValueType
-	fn            func(args ExpressionList, i int, record []Value) (*Value, error)
+	// variadic functions take a varying number of arguments, so an implicit
+	// column reference is never added to their arguments. They take at least
+	// minArguments arguments, and at most len(argumentTypes) if it is set.
+	variadic     bool
+	minArguments int
+	// projectsBool is true for functions whose boolean results are projected
+	// instead of being used as filters.
+	projectsBool bool
+	// returnType is the type of the result, or ValueTypeUnknown if it
+	// depends on the arguments.
+	returnType ValueType
+	fn         func(args ExpressionList, i int, record []Value) (*Value, error)
 }
 
 var funcMap = map[string]Function{
 	"has": {
 		argumentTypes: []ValueType{ValueTypeUnknown, ValueTypeString},
+		returnType:    ValueTypeBool,
 		fn: func(args ExpressionList, i int, record []Value) (*Value, error) {
 			col, err := args.exprs[0].Execute(i, record)
 			if err != nil {
@@ -59,6 +72,159 @@ var funcMap = map[string]Function{
 			}, nil
 		},
 	},
+	"if": {
+		argumentTypes: []ValueType{ValueTypeBool, ValueTypeUnknown, ValueTypeUnknown},
+		projectsBool:  true,
+		fn: func(args ExpressionList, i int, record []Value) (*Value, error) {
+			if len(args.exprs) != 3 {
+				return nil, fmt.Errorf("if requires exactly 3 arguments, got: %d", len(args.exprs))
+			}
+			cond, err := evaluateCondition(args.exprs[0], i, record)
+			if err != nil {
+				return nil, err
+			}
+			if cond {
+				return evaluateArgument(args.exprs[1], i, record)
+			}
+			return evaluateArgument(args.exprs[2], i, record)
+		},
+	},
+	"case": {
+		variadic:     true,
+		minArguments: 2,
+		projectsBool: true,
+		fn: func(args ExpressionList, i int, record []Value) (*Value, error) {
+			if len(args.exprs) < 2 {
+				return nil, fmt.Errorf("case requires at least 2 arguments, got: %d", len(args.exprs))
+			}
+			for j := 0; j+1 < len(args.exprs); j += 2 {
+				cond, err := evaluateCondition(args.exprs[j], i, record)
+				if err != nil {
+					return nil, err
+				}
+				if cond {
+					return evaluateArgument(args.exprs[j+1], i, record)
+				}
+			}
+			if len(args.exprs)%2 == 1 {
+				return evaluateArgument(args.exprs[len(args.exprs)-1], i, record)
+			}
+			return &Value{}, nil
+		},
+	},
+}
+
+func init() {
+	funcMap["int"] = castFunction("int", ValueTypeInt)
+	funcMap["float"] = castFunction("float", ValueTypeDouble)
+	funcMap["str"] = castFunction("str", ValueTypeString)
+	funcMap["bool"] = castFunction("bool", ValueTypeBool)
+	funcMap["date"] = Function{
+		argumentTypes: []ValueType{ValueTypeUnknown, ValueTypeString},
+		variadic:      true,
+		minArguments:  1,
+		returnType:    ValueTypeDate,
+		fn:            castDate,
+	}
+}
+
+func castFunction(name string, typ ValueType) Function {
+	return Function{
+		argumentTypes: []ValueType{ValueTypeUnknown},
+		returnType:    typ,
+		fn: func(args ExpressionList, i int, record []Value) (*Value, error) {
+			if len(args.exprs) != 1 {
+				return nil, fmt.Errorf("%v requires exactly 1 argument, got: %d", name, len(args.exprs))
+			}
+			v, err := evaluateArgument(args.exprs[0], i, record)
+			if err != nil {
+				return nil, err
+			}
+			return v.Convert(typ)
+		},
+	}
+}
+
+// dateLayouts are the names that can be used instead of a layout in date().
+var dateLayouts = map[string]string{
+	"rfc3339": time.RFC3339,
+	"rfc1123": time.RFC1123,
+}
+
+// castDate converts a value to a date. An optional layout is either the name
+// of a layout in dateLayouts, epoch or epochms for numbers of seconds or
+// milliseconds since the Unix epoch, or a layout in the format of time.Parse.
+func castDate(args ExpressionList, i int, record []Value) (*Value, error) {
+	if len(args.exprs) < 1 || len(args.exprs) > 2 {
+		return nil, fmt.Errorf("date requires between 1 and 2 arguments, got: %d", len(args.exprs))
+	}
+	v, err := evaluateArgument(args.exprs[0], i, record)
+	if err != nil {
+		return nil, err
+	}
+	if len(args.exprs) == 1 || v.IsNull() {
+		return v.Convert(ValueTypeDate)
+	}
+	layoutExpr, ok := args.exprs[1].(*LiteralExpression)
+	if p, isParameter := args.exprs[1].(*ParameterExpression); isParameter && p.value != nil {
+		layoutExpr, ok = p.value, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("date layout must be a literal, got: %v", args.exprs[1])
+	}
+	layout := layoutExpr.source
+	switch layout {
+	case "epoch":
+		return v.Convert(ValueTypeDate)
+	case "epochms":
+		ms, err := v.Convert(ValueTypeInt)
+		if err != nil {
+			return nil, err
+		}
+		return &Value{
+			typ:   ValueTypeDate,
+			value: time.UnixMilli(ms.value.(int64)).UTC(),
+		}, nil
+	}
+	if named, ok := dateLayouts[layout]; ok {
+		layout = named
+	}
+	t, err := time.Parse(layout, v.String())
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert %q to date: %w", v.String(), err)
+	}
+	return &Value{
+		typ:   ValueTypeDate,
+		value: t,
+	}, nil
+}
+
+// evaluateCondition evaluates the condition of an if or case, which must be
+// a boolean. A missing value, such as an empty cell, is false.
+func evaluateCondition(e Expression, i int, record []Value) (bool, error) {
+	res, err := e.Execute(i, record)
+	if err != nil {
+		return false, err
+	}
+	if s, ok := res.value.Str(); res.value.IsNull() || (ok && s == "") {
+		return false, nil
+	}
+	b, ok := res.value.Bool()
+	if !ok {
+		return false, fmt.Errorf("condition must be a boolean, got: %q", res.value.String())
+	}
+	return b, nil
+}
+
+func evaluateArgument(e Expression, i int, record []Value) (*Value, error) {
+	res, err := e.Execute(i, record)
+	if err != nil {
+		return nil, err
+	}
+	if res.value == nil {
+		return &Value{}, nil
+	}
+	return res.value, nil
 }
 
 type AggregationFunction struct {
@@ -111,12 +277,29 @@ func (el *ExpressionList) Type() ExpressionType {
 type Funcall struct {
 	funcName  string
 	arguments ExpressionList
+	pos       position
+	// function is the function that is called, which is set when the query
+	// is bound.
+	function *Function
+	// implicit is the implicit column reference of the operation the call
+	// is in, which is used as the first argument if one is missing.
+	implicit Expression
+}
+
+// resolved returns the function that is called. Before the query is bound,
+// only built-in functions are found.
+func (f *Funcall) resolved() (Function, bool) {
+	if f.function != nil {
+		return *f.function, true
+	}
+	fn, ok := funcMap[f.funcName]
+	return fn, ok
 }
 
 func (f *Funcall) Execute(i int, record []Value) (*OperationResult, error) {
-	fn, ok := funcMap[f.funcName]
+	fn, ok := f.resolved()
 	if !ok {
-		return nil, fmt.Errorf("function '%v' not found", fn)
+		return nil, fmt.Errorf("function '%v' not found", f.funcName)
 	}
 	res, err := fn.fn(f.arguments, i, record)
 	if err != nil {
@@ -129,9 +312,7 @@ func (f *Funcall) Execute(i int, record []Value) (*OperationResult, error) {
 
 func (f *Funcall) FillNils(e Expression) {
 	if len(f.arguments.exprs) > 0 {
-		if f.arguments.exprs[0].Type() != ExpressionColumnReference {
-			f.arguments.exprs = append([]Expression{e}, f.arguments.exprs...)
-		}
+		f.implicit = e
 		f.arguments.FillNils(e)
 	} else {
 		f.arguments = ExpressionList{
@@ -140,6 +321,13 @@ func (f *Funcall) FillNils(e Expression) {
 	}
 }
 
+// projectsBool returns true if a boolean result of the function should be
+// projected rather than used as a filter.
+func (f *Funcall) projectsBool() bool {
+	fn, ok := f.resolved()
+	return ok && fn.projectsBool
+}
+
 func (f *Funcall) String() string {
 	return fmt.Sprintf("(Funcall: Name=%v Args={%v})", f.funcName, f.arguments)
 }
@@ -161,7 +349,7 @@ func (f *GroupingExpr) Execute(i int, record []Value) (*OperationResult, error)
 			return nil, err
 		}
 		if res != nil {
-			ret = append(ret, *res.value)
+			ret = expandResult(ret, a, res.value)
 		}
 	}
 
@@ -194,6 +382,22 @@ func (f *GroupingExpr) Type() ExpressionType {
 type AggregatingExpr struct {
 	aggregationName string
 	argument        Expression
+	// argumentCount is the number of arguments in the query, which is
+	// checked when the query is bound.
+	argumentCount int
+	pos           position
+	// function is set when the query is bound.
+	function *AggregationFunction
+}
+
+// resolved returns the aggregation function. Before the query is bound, only
+// built-in aggregations are found.
+func (f *AggregatingExpr) resolved() (AggregationFunction, bool) {
+	if f.function != nil {
+		return *f.function, true
+	}
+	fn, ok := aggregationFuncMap[f.aggregationName]
+	return fn, ok
 }
 
 func (f *AggregatingExpr) Execute(i int, record []Value) (*OperationResult, error) {
@@ -218,8 +422,6 @@ func (f *AggregatingExpr) Type() ExpressionType {
 	return ExpressionAggregating
 }
 
-const MaxOrderingExprCount = 10
-
 type OrderDirection int
 
 const (
@@ -227,9 +429,31 @@ const (
 	OrderDirectionDesc
 )
 
+type NullsOrder int
+
+const (
+	// NullsDefault sorts nulls as the smallest value, so they come first when
+	// sorting ascending and last when sorting descending.
+	NullsDefault NullsOrder = iota
+	NullsFirst
+	NullsLast
+)
+
+type Collation int
+
+const (
+	CollationBinary Collation = iota
+	CollationNoCase
+	// CollationNatural compares runs of digits in strings by their numeric
+	// value, so that "file2" sorts before "file10".
+	CollationNatural
+)
+
 type OrderingExpr struct {
 	argument  Expression
 	direction OrderDirection
+	nulls     NullsOrder
+	collation Collation
 }
 
 func (f *OrderingExpr) Execute(i int, record []Value) (*OperationResult, error) {
@@ -254,7 +478,36 @@ func (f *OrderingExpr) FillNils(e Expression) {
 }
 
 func (f *OrderingExpr) String() string {
-	return fmt.Sprintf("(Ordering: Arg={%v} Direction=%v)", f.argument, f.direction)
+	return fmt.Sprintf("(Ordering: Arg={%v} Direction=%v Nulls=%v Collation=%v)", f.argument, f.direction, f.nulls, f.collation)
+}
+
+func (f *OrderingExpr) setOption(option string) error {
+	switch strings.Join(strings.Fields(strings.ToLower(option)), " ") {
+	case "asc":
+		f.direction = OrderDirectionAsc
+	case "desc":
+		f.direction = OrderDirectionDesc
+	case "nulls first", "nullsfirst":
+		f.nulls = NullsFirst
+	case "nulls last", "nullslast":
+		f.nulls = NullsLast
+	case "nocase":
+		f.collation = CollationNoCase
+	case "natural":
+		f.collation = CollationNatural
+	case "binary":
+		f.collation = CollationBinary
+	default:
+		return fmt.Errorf("order by option must be one of 'asc', 'desc', 'nulls first', 'nulls last', 'nocase', 'natural' or 'binary', got: %v", option)
+	}
+	return nil
+}
+
+func (f *OrderingExpr) nullsFirst() bool {
+	if f.nulls == NullsDefault {
+		return f.direction == OrderDirectionAsc
+	}
+	return f.nulls == NullsFirst
 }
 
 func (f *OrderingExpr) Type() ExpressionType {
@@ -262,7 +515,8 @@ func (f *OrderingExpr) Type() ExpressionType {
 }
 
 type LimitExpr struct {
-	limit int64
+	limit  int64
+	offset int64
 }
 
 func (f *LimitExpr) Execute(i int, record []Value) (*OperationResult, error) {
@@ -274,9 +528,332 @@ func (f *LimitExpr) FillNils(e Expression) {
 }
 
 func (f *LimitExpr) String() string {
-	return fmt.Sprintf("(Limit: %d)", f.limit)
+	return fmt.Sprintf("(Limit: %d Offset: %d)", f.limit, f.offset)
 }
 
 func (f *LimitExpr) Type() ExpressionType {
 	return ExpressionLimit
 }
+
+type TailExpr struct {
+	n int64
+}
+
+func (f *TailExpr) Execute(i int, record []Value) (*OperationResult, error) {
+	return nil, fmt.Errorf("tail expressions cannot be executed")
+}
+
+func (f *TailExpr) FillNils(e Expression) {
+	// Tail expressions do not have arguments to fill
+}
+
+func (f *TailExpr) String() string {
+	return fmt.Sprintf("(Tail: %d)", f.n)
+}
+
+func (f *TailExpr) Type() ExpressionType {
+	return ExpressionTail
+}
+
+type SampleExpr struct {
+	n      int64
+	seed   int64
+	seeded bool
+}
+
+func (f *SampleExpr) Execute(i int, record []Value) (*OperationResult, error) {
+	return nil, fmt.Errorf("sample expressions cannot be executed")
+}
+
+func (f *SampleExpr) FillNils(e Expression) {
+	// Sample expressions do not have arguments to fill
+}
+
+func (f *SampleExpr) String() string {
+	if f.seeded {
+		return fmt.Sprintf("(Sample: %d Seed: %d)", f.n, f.seed)
+	}
+	return fmt.Sprintf("(Sample: %d)", f.n)
+}
+
+func (f *SampleExpr) Type() ExpressionType {
+	return ExpressionSample
+}
+
+type DistinctExpr struct {
+	arguments ExpressionList
+}
+
+// Execute returns the values that identify a row as a duplicate. If distinct
+// has no arguments, the whole row is used.
+func (f *DistinctExpr) Execute(i int, record []Value) (*OperationResult, error) {
+	if len(f.arguments.exprs) == 0 {
+		return &OperationResult{
+			value: &Value{
+				typ:   ValueTypeList,
+				value: record,
+			},
+		}, nil
+	}
+
+	ret := []Value{}
+	for _, a := range f.arguments.exprs {
+		res, err := a.Execute(i, record)
+		if err != nil {
+			return nil, err
+		}
+		if res != nil && res.value != nil {
+			ret = expandResult(ret, a, res.value)
+		}
+	}
+
+	return &OperationResult{
+		value: &Value{
+			typ:   ValueTypeList,
+			value: ret,
+		},
+	}, nil
+}
+
+func (f *DistinctExpr) FillNils(e Expression) {
+	f.arguments.FillNils(e)
+}
+
+func (f *DistinctExpr) String() string {
+	return fmt.Sprintf("(Distinct: Args={%v})", f.arguments)
+}
+
+func (f *DistinctExpr) Type() ExpressionType {
+	return ExpressionDistinct
+}
+
+var windowFunctionNames = []string{
+	"rownum",
+	"rank",
+	"cumsum",
+	"lag",
+	"lead",
+	"movavg",
+}
+
+// WindowExpr is a function that is evaluated over all the rows of a result
+// set, or over the rows with the same partition key, while keeping every row.
+type WindowExpr struct {
+	funcName string
+	argument Expression
+	// order is the value rows are ranked by for rank.
+	order *OrderingExpr
+	// n is the offset for lag and lead, and the number of rows for movavg.
+	n         int64
+	partition ExpressionList
+}
+
+func (f *WindowExpr) Execute(i int, record []Value) (*OperationResult, error) {
+	return nil, fmt.Errorf("window function '%v' can only be evaluated over a result set", f.funcName)
+}
+
+func (f *WindowExpr) FillNils(e Expression) {
+	if f.order != nil {
+		f.order.FillNils(e)
+	} else if f.argument != nil {
+		if f.argument.Type() == ExpressionNop {
+			f.argument = e
+		} else {
+			f.argument.FillNils(e)
+		}
+	}
+	f.partition.FillNils(e)
+}
+
+func (f *WindowExpr) String() string {
+	if f.order != nil {
+		return fmt.Sprintf("(Window: Name=%v Order={%v} Over={%v})", f.funcName, f.order, f.partition)
+	}
+	return fmt.Sprintf("(Window: Name=%v Arg={%v} N=%d Over={%v})", f.funcName, f.argument, f.n, f.partition)
+}
+
+func (f *WindowExpr) Type() ExpressionType {
+	return ExpressionWindow
+}
+
+type JoinType int
+
+const (
+	// JoinTypeInner keeps the rows that have a match in the joined file.
+	JoinTypeInner JoinType = iota
+	// JoinTypeLeft keeps all rows, with empty joined columns when there is no match.
+	JoinTypeLeft
+	// JoinTypeAnti keeps the rows that have no match, without joined columns.
+	JoinTypeAnti
+)
+
+type JoinExpr struct {
+	// source is the name of a file in Options.JoinSources or a path.
+	source   string
+	leftKey  Expression
+	rightKey Expression
+	joinType JoinType
+}
+
+func (f *JoinExpr) Execute(i int, record []Value) (*OperationResult, error) {
+	return f.leftKey.Execute(i, record)
+}
+
+func (f *JoinExpr) FillNils(e Expression) {
+	if f.leftKey.Type() == ExpressionNop {
+		f.leftKey = e
+	} else {
+		f.leftKey.FillNils(e)
+	}
+	if f.rightKey.Type() == ExpressionNop {
+		f.rightKey = e
+	} else {
+		f.rightKey.FillNils(e)
+	}
+}
+
+func (f *JoinExpr) String() string {
+	return fmt.Sprintf("(Join: Source=%v Left={%v} Right={%v} Type=%d)", f.source, f.leftKey, f.rightKey, f.joinType)
+}
+
+func (f *JoinExpr) Type() ExpressionType {
+	return ExpressionJoin
+}
+
+// PivotExpr turns the rows of a result set into columns. There is one row for
+// each distinct row key and one column for each distinct column key, with the
+// aggregated values in the cells.
+type PivotExpr struct {
+	rowKey    Expression
+	colKey    Expression
+	aggregate *AggregatingExpr
+}
+
+func (f *PivotExpr) Execute(i int, record []Value) (*OperationResult, error) {
+	return nil, fmt.Errorf("pivot can only be evaluated over a result set")
+}
+
+func (f *PivotExpr) FillNils(e Expression) {
+	if f.rowKey.Type() == ExpressionNop {
+		f.rowKey = e
+	} else {
+		f.rowKey.FillNils(e)
+	}
+	if f.colKey.Type() == ExpressionNop {
+		f.colKey = e
+	} else {
+		f.colKey.FillNils(e)
+	}
+	f.aggregate.FillNils(e)
+}
+
+func (f *PivotExpr) String() string {
+	return fmt.Sprintf("(Pivot: Row={%v} Column={%v} Value={%v})", f.rowKey, f.colKey, f.aggregate)
+}
+
+func (f *PivotExpr) Type() ExpressionType {
+	return ExpressionPivot
+}
+
+// UnpivotExpr turns columns into rows with the name of the column and its value.
+type UnpivotExpr struct {
+	columns []Expression
+	// header is true if the first row holds the names of the columns.
+	header bool
+}
+
+func (f *UnpivotExpr) Execute(i int, record []Value) (*OperationResult, error) {
+	return nil, fmt.Errorf("unpivot can only be evaluated over a result set")
+}
+
+func (f *UnpivotExpr) FillNils(e Expression) {
+}
+
+func (f *UnpivotExpr) String() string {
+	return fmt.Sprintf("(Unpivot: Columns={%v} Header=%v)", f.columns, f.header)
+}
+
+func (f *UnpivotExpr) Type() ExpressionType {
+	return ExpressionUnpivot
+}
+
+// WhereExpr marks an operation as a filter. It is written as where(x) or ?x.
+type WhereExpr struct {
+	inner Expression
+}
+
+func (f *WhereExpr) Execute(i int, record []Value) (*OperationResult, error) {
+	res, err := f.inner.Execute(i, record)
+	if err != nil {
+		return nil, err
+	}
+	if res.value == nil || res.value.typ != ValueTypeBool {
+		return nil, fmt.Errorf("filter must be a boolean, got: %v", res.value)
+	}
+	return res, nil
+}
+
+func (f *WhereExpr) FillNils(e Expression) {
+	if f.inner.Type() == ExpressionNop {
+		f.inner = e
+	} else {
+		f.inner.FillNils(e)
+	}
+}
+
+func (f *WhereExpr) String() string {
+	return fmt.Sprintf("(Where: {%v})", f.inner)
+}
+
+func (f *WhereExpr) Type() ExpressionType {
+	return ExpressionWhere
+}
+
+// KeepExpr marks an operation as a projection, so that a boolean result is
+// kept in the result set instead of being used as a filter.
+type KeepExpr struct {
+	inner Expression
+}
+
+func (f *KeepExpr) Execute(i int, record []Value) (*OperationResult, error) {
+	return f.inner.Execute(i, record)
+}
+
+func (f *KeepExpr) FillNils(e Expression) {
+	if f.inner.Type() == ExpressionNop {
+		f.inner = e
+	} else {
+		f.inner.FillNils(e)
+	}
+}
+
+func (f *KeepExpr) String() string {
+	return fmt.Sprintf("(Keep: {%v})", f.inner)
+}
+
+func (f *KeepExpr) Type() ExpressionType {
+	return ExpressionKeep
+}
+
+// LetExpr is a let step, which defines the parameter :name as the value of
+// a constant expression for the steps after it.
+type LetExpr struct {
+	name  string
+	value Expression
+	pos   position
+}
+
+func (f *LetExpr) Execute(i int, record []Value) (*OperationResult, error) {
+	return nil, fmt.Errorf("let expressions cannot be executed")
+}
+
+func (f *LetExpr) FillNils(e Expression) {
+}
+
+func (f *LetExpr) String() string {
+	return fmt.Sprintf("(Let: Name=%v Value={%v})", f.name, f.value)
+}
+
+func (f *LetExpr) Type() ExpressionType {
+	return ExpressionLet
+}
@@ -37,6 +37,8 @@ func (o *Nop) String() string {
 
 type LiteralExpression struct {
 	value Value
+	// source is the literal as it was written in the query.
+	source string
 }
 
 func (l *LiteralExpression) Execute(i int, record []Value) (*OperationResult, error) {
@@ -56,19 +58,67 @@ func (l *LiteralExpression) String() string {
 	return fmt.Sprintf("(Literal: Value=%v)", l.value)
 }
 
+// ParameterExpression is a :name parameter. Its value is set when the query
+// is bound, either from Options.Parameters or from a let step.
+type ParameterExpression struct {
+	name  string
+	value *LiteralExpression
+	pos   position
+}
+
+func (p *ParameterExpression) Execute(i int, record []Value) (*OperationResult, error) {
+	if p.value == nil {
+		return nil, fmt.Errorf("parameter :%v is not defined", p.name)
+	}
+	return p.value.Execute(i, record)
+}
+
+func (p *ParameterExpression) FillNils(e Expression) {
+}
+
+func (p *ParameterExpression) Type() ExpressionType {
+	return ExpressionParameter
+}
+
+func (p *ParameterExpression) String() string {
+	return fmt.Sprintf("(Parameter: Name=%v Value=%v)", p.name, p.value)
+}
+
+// ColumnReferenceExpression references a column by index. Negative indexes
+// count from the end of the row, so $-1 is the last column.
 type ColumnReferenceExpression struct {
 	index int
+	// implicit is true if the reference was not written in the query, but
+	// filled in for the operation at this index.
+	implicit bool
 }
 
 func (c *ColumnReferenceExpression) Execute(i int, record []Value) (*OperationResult, error) {
-	if c.index >= len(record) {
-		return nil, fmt.Errorf("index out of range, index: %v, record length: %v, record: %v", c.index, len(record), record)
+	idx, ok := c.resolve(len(record))
+	if !ok {
+		return nil, columnOutOfRange(c.index, len(record))
 	}
 	return &OperationResult{
-		value: &record[c.index],
+		value: &record[idx],
 	}, nil
 }
 
+// resolve returns the index of the referenced column in a row with n columns.
+func (c *ColumnReferenceExpression) resolve(n int) (int, bool) {
+	return resolveColumn(c.index, n)
+}
+
+func resolveColumn(index int, n int) (int, bool) {
+	if index < 0 {
+		index += n
+	}
+	return index, index >= 0 && index < n
+}
+
+func columnOutOfRange(index int, n int) error {
+	return fmt.Errorf("column $%d is out of range, the row only has %d columns", index, n)
+}
+
 func (o *ColumnReferenceExpression) FillNils(e Expression) {
 }
 
@@ -79,3 +129,95 @@ func (c *ColumnReferenceExpression) Type() ExpressionType {
 func (c *ColumnReferenceExpression) String() string {
 	return fmt.Sprintf("(ColumnRef: Index=%v)", c.index)
 }
+
+// ColumnRangeExpression references several columns. It is either all columns,
+// written $*, or the columns from one index to another, both inclusive, for
+// example $2..$5. Columns can be left out with !, as in $*!$3. When a range is
+// projected, grouped on or used in distinct, it is expanded into one value per
+// column.
+type ColumnRangeExpression struct {
+	from    int
+	to      int
+	all     bool
+	exclude []Expression
+}
+
+func (c *ColumnRangeExpression) Execute(i int, record []Value) (*OperationResult, error) {
+	indexes, err := c.indexes(len(record))
+	if err != nil {
+		return nil, err
+	}
+	values := make([]Value, len(indexes))
+	for j, idx := range indexes {
+		values[j] = record[idx]
+	}
+	return &OperationResult{
+		value: &Value{
+			typ:   ValueTypeList,
+			value: values,
+		},
+	}, nil
+}
+
+// indexes returns the indexes of the referenced columns in a row with n columns.
+func (c *ColumnRangeExpression) indexes(n int) ([]int, error) {
+	from, to := 0, n-1
+	if !c.all {
+		var ok bool
+		if from, ok = resolveColumn(c.from, n); !ok {
+			return nil, columnOutOfRange(c.from, n)
+		}
+		if to, ok = resolveColumn(c.to, n); !ok {
+			return nil, columnOutOfRange(c.to, n)
+		}
+	}
+	excluded := map[int]bool{}
+	for _, e := range c.exclude {
+		switch e := e.(type) {
+		case *ColumnReferenceExpression:
+			idx, ok := e.resolve(n)
+			if !ok {
+				return nil, columnOutOfRange(e.index, n)
+			}
+			excluded[idx] = true
+		case *ColumnRangeExpression:
+			idxs, err := e.indexes(n)
+			if err != nil {
+				return nil, err
+			}
+			for _, idx := range idxs {
+				excluded[idx] = true
+			}
+		}
+	}
+	res := []int{}
+	for idx := from; idx <= to; idx++ {
+		if !excluded[idx] {
+			res = append(res, idx)
+		}
+	}
+	return res, nil
+}
+
+func (o *ColumnRangeExpression) FillNils(e Expression) {
+}
+
+func (c *ColumnRangeExpression) Type() ExpressionType {
+	return ExpressionColumnRange
+}
+
+func (c *ColumnRangeExpression) String() string {
+	if c.all {
+		return fmt.Sprintf("(ColumnRange: All Exclude={%v})", c.exclude)
+	}
+	return fmt.Sprintf("(ColumnRange: From=%v To=%v Exclude={%v})", c.from, c.to, c.exclude)
+}
+
+// expandResult appends the result of an expression to values. The result of a
+// column range is expanded into one value per column.
+func expandResult(values []Value, op Expression, res *Value) []Value {
+	if op.Type() == ExpressionColumnRange {
+		return append(values, res.value.([]Value)...)
+	}
+	return append(values, *res)
+}
@@ -14,15 +14,32 @@ func _() {
 	_ = x[ExpressionColumnReference-3]
 	_ = x[ExpressionExprList-4]
 	_ = x[ExpressionFuncall-5]
+	_ = x[ExpressionGrouping-6]
+	_ = x[ExpressionAggregating-7]
+	_ = x[ExpressionOrdering-8]
+	_ = x[ExpressionLimit-9]
+	_ = x[ExpressionDistinct-10]
+	_ = x[ExpressionTail-11]
+	_ = x[ExpressionSample-12]
+	_ = x[ExpressionWindow-13]
+	_ = x[ExpressionJoin-14]
+	_ = x[ExpressionColumnRange-15]
+	_ = x[ExpressionPivot-16]
+	_ = x[ExpressionUnpivot-17]
+	_ = x[ExpressionWhere-18]
+	_ = x[ExpressionKeep-19]
+	_ = x[ExpressionParameter-20]
+	_ = x[ExpressionLet-21]
 }
 
-const _ExpressionType_name = "ExpressionNopExpressionOperatorExpressionLiteralExpressionColumnReferenceExpressionExprListExpressionFuncall"
+const _ExpressionType_name = "ExpressionNopExpressionOperatorExpressionLiteralExpressionColumnReferenceExpressionExprListExpressionFuncallExpressionGroupingExpressionAggregatingExpressionOrderingExpressionLimitExpressionDistinctExpressionTailExpressionSampleExpressionWindowExpressionJoinExpressionColumnRangeExpressionPivotExpressionUnpivotExpressionWhereExpressionKeepExpressionParameterExpressionLet"
 
-var _ExpressionType_index = [...]uint8{0, 13, 31, 48, 73, 91, 108}
+var _ExpressionType_index = [...]uint16{0, 13, 31, 48, 73, 91, 108, 126, 147, 165, 180, 198, 212, 228, 244, 258, 279, 294, 311, 326, 340, 359, 372}
 
 func (i ExpressionType) String() string {
-	if i < 0 || i >= ExpressionType(len(_ExpressionType_index)-1) {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_ExpressionType_index)-1 {
 		return "ExpressionType(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _ExpressionType_name[_ExpressionType_index[i]:_ExpressionType_index[i+1]]
+	return _ExpressionType_name[_ExpressionType_index[idx]:_ExpressionType_index[idx+1]]
 }
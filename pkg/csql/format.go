@@ -0,0 +1,124 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"sort"
+	"strings"
+)
+
+// Format parses a query and writes it back in canonical form, with one step
+// per line and no spaces or options that do not change the meaning of the
+// query. If explicit is true, implicit column references are written out,
+// except after ! or on the right hand side of an operator, as in !=a, since
+// !$0=a would negate $0 instead of the comparison.
+// Comments, macro definitions and single blank lines between steps are kept.
+// Formatting a formatted query returns it unchanged.
+func Format(query string, explicit bool) (string, error) {
+	p := newParser()
+	tokens := Tokenize(query)
+	steps, positions, err := p.parseQuery(tokens)
+	if err != nil {
+		return "", err
+	}
+	// Steps and definitions continued with \ span several lines, and a
+	// comment can be on any of them.
+	lastLines := map[int]int{}
+	for start := 0; start < len(tokens); {
+		end := start
+		for end < len(tokens)-1 && tokens[end].Typ != TokenTypeNewLine {
+			end++
+		}
+		lastLines[tokens[start].Line] = tokens[end].Line
+		start = end + 1
+	}
+	pr := &printer{
+		explicit: explicit,
+		macros:   p.uses,
+	}
+
+	type line struct {
+		number int
+		last   int
+		text   string
+	}
+	lines := []line{}
+	for i, ops := range steps {
+		strs := make([]string, len(ops))
+		for j, op := range ops {
+			strs[j] = pr.operation(op)
+		}
+		lines = append(lines, line{positions[i].line, lastLines[positions[i].line], strings.Join(strs, ",")})
+	}
+	for _, def := range p.defs {
+		// The body of a macro is written as it was parsed, since its implicit
+		// column references depend on where the macro is used.
+		body := (&printer{macros: p.uses}).operation(def.value)
+		lines = append(lines, line{def.pos.line, lastLines[def.pos.line], "def " + def.name + " = " + body})
+	}
+
+	comments := map[int]string{}
+	blank := map[int]bool{}
+	for i, l := range strings.Split(query, "\n") {
+		if comment, ok := lineComment(l); ok {
+			comments[i+1] = comment
+		} else if strings.TrimSpace(l) == "" {
+			blank[i+1] = true
+		}
+	}
+	for i := range lines {
+		for n := lines[i].number; n <= lines[i].last; n++ {
+			if comment, ok := comments[n]; ok {
+				lines[i].text += " " + comment
+				delete(comments, n)
+			}
+		}
+	}
+	for number, comment := range comments {
+		lines = append(lines, line{number, number, comment})
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].number < lines[j].number
+	})
+
+	sb := strings.Builder{}
+	for i, l := range lines {
+		if i > 0 {
+			for n := lines[i-1].last + 1; n < l.number; n++ {
+				if blank[n] {
+					sb.WriteString("\n")
+					break
+				}
+			}
+		}
+		sb.WriteString(l.text)
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+// lineComment returns the comment on a line of a query, using the same rule
+// as Tokenize: a # at the start of the line or after whitespace.
+func lineComment(line string) (string, bool) {
+	runes := []rune(line)
+	for i, c := range runes {
+		if c == '#' && (i == 0 || isSpace(runes[i-1])) {
+			return strings.TrimRight(string(runes[i:]), " \t\r"), true
+		}
+	}
+	return "", false
+}
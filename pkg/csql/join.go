@@ -0,0 +1,146 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// joinStage is a hash join. The joined file is read into a hash table keyed
+// by the right key, and the rows of the input are streamed past it.
+type joinStage struct {
+	ctx      context.Context
+	input    rowIterator
+	joinExpr *JoinExpr
+	options  *Options
+	table    map[string][][]Value
+	// width is the number of columns in the widest row of the joined file,
+	// used to pad rows without a match in a left join.
+	width   int
+	pending [][]Value
+}
+
+func (s *joinStage) Next() ([]Value, error) {
+	if s.table == nil {
+		if err := s.build(); err != nil {
+			return nil, err
+		}
+	}
+	for len(s.pending) == 0 {
+		record, err := s.input.Next()
+		if err != nil {
+			return nil, err
+		}
+		key, ok, err := joinKey(s.joinExpr.leftKey, record)
+		if err != nil {
+			return nil, err
+		}
+		var matches [][]Value
+		if ok {
+			matches = s.table[key]
+		}
+		switch s.joinExpr.joinType {
+		case JoinTypeInner:
+			for _, m := range matches {
+				s.pending = append(s.pending, joinRows(record, m, s.width))
+			}
+		case JoinTypeLeft:
+			if len(matches) == 0 {
+				s.pending = append(s.pending, joinRows(record, nil, s.width))
+			}
+			for _, m := range matches {
+				s.pending = append(s.pending, joinRows(record, m, s.width))
+			}
+		case JoinTypeAnti:
+			if len(matches) == 0 {
+				s.pending = append(s.pending, record)
+			}
+		}
+	}
+	row := s.pending[0]
+	s.pending = s.pending[1:]
+	return row, nil
+}
+
+func (s *joinStage) build() error {
+	path, ok := s.options.JoinSources[s.joinExpr.source]
+	if !ok {
+		if s.options.NoJoinPaths {
+			return fmt.Errorf("join: %v is not a registered join source", s.joinExpr.source)
+		}
+		path = s.joinExpr.source
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("join: %w", err)
+	}
+	defer f.Close()
+
+	// The limit on input rows only applies to the main input. The joined
+	// file is read with the same separator and skips the same header rows.
+	options := *s.options
+	options.MaxInputRows = 0
+	source, err := newCSVSource(s.ctx, f, options)
+	if err != nil {
+		return err
+	}
+	s.table = map[string][][]Value{}
+	for {
+		record, err := source.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("join: %w", err)
+		}
+		key, ok, err := joinKey(s.joinExpr.rightKey, record)
+		if err != nil {
+			return err
+		}
+		s.width = max(s.width, len(record))
+		if !ok {
+			continue
+		}
+		s.table[key] = append(s.table[key], record)
+	}
+}
+
+// joinKey returns the key a record is joined on. Like in SQL, null keys do
+// not match anything, so false is returned for them.
+func joinKey(keyExpr Expression, record []Value) (string, bool, error) {
+	res, err := keyExpr.Execute(0, record)
+	if err != nil {
+		return "", false, err
+	}
+	if res.value.IsNull() {
+		return "", false, nil
+	}
+	return rowKey([]Value{*res.value}), true, nil
+}
+
+func joinRows(left, right []Value, width int) []Value {
+	row := make([]Value, len(left), len(left)+width)
+	copy(row, left)
+	row = append(row, right...)
+	for len(row) < len(left)+width {
+		row = append(row, Value{})
+	}
+	return row
+}
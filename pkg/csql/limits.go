@@ -0,0 +1,77 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrLimitExceeded = errors.New("resource limit exceeded")
+
+type LimitAction int
+
+const (
+	// LimitActionError fails the query when a limit is hit.
+	LimitActionError LimitAction = iota
+	// LimitActionTruncate discards the rows or groups that do not fit within
+	// the limit and writes a warning to Options.Warnings.
+	LimitActionTruncate
+)
+
+type LimitKind int
+
+const (
+	LimitInputRows LimitKind = iota
+	LimitGroups
+	LimitOrderRows
+)
+
+type LimitError struct {
+	Kind LimitKind
+	Max  int
+	Step int
+}
+
+func (e *LimitError) Error() string {
+	switch e.Kind {
+	case LimitInputRows:
+		return fmt.Sprintf("input has more than the maximum of %d rows", e.Max)
+	case LimitGroups:
+		return fmt.Sprintf("step %d produced more than the maximum of %d distinct groups", e.Step, e.Max)
+	case LimitOrderRows:
+		return fmt.Sprintf("step %d would buffer more than the maximum of %d rows for ordering", e.Step, e.Max)
+	}
+	return fmt.Sprintf("limit %d exceeded", e.Max)
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+// limitExceeded is called the first time a limit is hit. It returns the error
+// that should fail the query, or nil if the query should continue with
+// truncated data.
+func (o *Options) limitExceeded(err *LimitError) error {
+	if o.OnLimit != LimitActionTruncate {
+		return err
+	}
+	if o.Warnings != nil {
+		fmt.Fprintf(o.Warnings, "warning: %v, the result has been truncated\n", err)
+	}
+	return nil
+}
@@ -16,18 +16,132 @@
 
 package csql
 
+import (
+	"io"
+	"os"
+)
+
 type Options struct {
 	PrintOps   bool
 	PrintTypes bool
 	Separator  string
 	Skip       int
+
+	// Limits on how much data a query may hold in memory. Zero means no limit.
+	MaxInputRows int
+	MaxGroups    int
+	MaxOrderRows int
+	OnLimit      LimitAction
+	Warnings     io.Writer
+
+	// SortMemoryRows is how many rows order() sorts in memory before spilling
+	// sorted runs to temporary files in TempDir. Zero means never spill.
+	SortMemoryRows int
+	TempDir        string
+
+	// Parallelism is how many goroutines filter, projection and grouping
+	// steps are spread over. The result is the same as with a single goroutine.
+	Parallelism int
+
+	// Strict type checks the query against the types of the columns in the
+	// first rows of the input before running it.
+	Strict bool
+
+	// JoinSources maps names that can be used in join() to file paths, so
+	// that paths which cannot be written in a query can still be joined.
+	JoinSources map[string]string
+	// NoJoinPaths restricts join() to the names in JoinSources, so that
+	// queries from untrusted users cannot read other files.
+	NoJoinPaths bool
+
+	// Parameters are the values of the :name parameters in the query. They
+	// are parsed in the same way as literals in the query.
+	Parameters map[string]string
 }
 
 func NewOptions() Options {
 	return Options{
-		PrintOps:   false,
-		PrintTypes: false,
-		Separator:  ",",
-		Skip:       0,
+		PrintOps:     false,
+		PrintTypes:   false,
+		Separator:    ",",
+		Skip:         0,
+		MaxInputRows: 0,
+		MaxGroups:    0,
+		MaxOrderRows: 0,
+		OnLimit:      LimitActionError,
+		Warnings:     os.Stderr,
+
+		SortMemoryRows: 1000000,
+		TempDir:        os.TempDir(),
+
+		Parallelism: 1,
+
+		JoinSources: map[string]string{},
+		Parameters:  map[string]string{},
+	}
+}
+
+type Option func(*Options)
+
+func WithOptions(o Options) Option {
+	return func(options *Options) {
+		*options = o
+	}
+}
+
+func WithSeparator(separator string) Option {
+	return func(options *Options) {
+		options.Separator = separator
+	}
+}
+
+func WithSkip(skip int) Option {
+	return func(options *Options) {
+		options.Skip = skip
+	}
+}
+
+func WithLimits(maxInputRows, maxGroups, maxOrderRows int, onLimit LimitAction) Option {
+	return func(options *Options) {
+		options.MaxInputRows = maxInputRows
+		options.MaxGroups = maxGroups
+		options.MaxOrderRows = maxOrderRows
+		options.OnLimit = onLimit
+	}
+}
+
+func WithParallelism(n int) Option {
+	return func(options *Options) {
+		options.Parallelism = n
+	}
+}
+
+func WithJoinSource(name, path string) Option {
+	return func(options *Options) {
+		if options.JoinSources == nil {
+			options.JoinSources = map[string]string{}
+		}
+		options.JoinSources[name] = path
+	}
+}
+
+func WithoutJoinPaths() Option {
+	return func(options *Options) {
+		options.NoJoinPaths = true
+	}
+}
+
+func WithStrict(strict bool) Option {
+	return func(options *Options) {
+		options.Strict = strict
+	}
+}
+
+func WithParameter(name, value string) Option {
+	return func(options *Options) {
+		if options.Parameters == nil {
+			options.Parameters = map[string]string{}
+		}
+		options.Parameters[name] = value
 	}
 }
@@ -0,0 +1,298 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"hash/maphash"
+	"io"
+	"sync"
+)
+
+// parallelBatchSize is how many rows are handed to a worker at a time.
+const parallelBatchSize = 256
+
+type batchResult[T any] struct {
+	items []T
+	err   error
+}
+
+type batchJob[T any] struct {
+	// first is the index of the first row of the batch in the input.
+	first  int
+	rows   [][]Value
+	result chan batchResult[T]
+}
+
+// runOrdered reads batches of rows from input and calls fn on each batch on
+// one of workers goroutines. The results are delivered on the returned channel
+// in the same order as the batches were read, so the output is the same as if
+// fn had been called on each batch in turn. fn is also given the index of the
+// first row of the batch in the input. Closing done stops the goroutines.
+func runOrdered[T any](input rowIterator, workers int, done <-chan struct{}, fn func(first int, rows [][]Value) ([]T, error)) <-chan batchResult[T] {
+	out := make(chan batchResult[T], workers)
+	pending := make(chan chan batchResult[T], workers*2)
+	jobs := make(chan batchJob[T], workers)
+
+	go func() {
+		defer close(pending)
+		defer close(jobs)
+		read := 0
+		for {
+			rows := make([][]Value, 0, parallelBatchSize)
+			var err error
+			for len(rows) < parallelBatchSize {
+				var row []Value
+				row, err = input.Next()
+				if err != nil {
+					break
+				}
+				rows = append(rows, row)
+			}
+			if len(rows) > 0 {
+				result := make(chan batchResult[T], 1)
+				select {
+				case pending <- result:
+				case <-done:
+					return
+				}
+				select {
+				case jobs <- batchJob[T]{first: read, rows: rows, result: result}:
+				case <-done:
+					return
+				}
+				read += len(rows)
+			}
+			if err != nil {
+				if err != io.EOF {
+					result := make(chan batchResult[T], 1)
+					result <- batchResult[T]{err: err}
+					select {
+					case pending <- result:
+					case <-done:
+					}
+				}
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for job := range jobs {
+				items, err := fn(job.first, job.rows)
+				job.result <- batchResult[T]{items: items, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(out)
+		for result := range pending {
+			var r batchResult[T]
+			select {
+			case r = <-result:
+			case <-done:
+				return
+			}
+			select {
+			case out <- r:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// parallelStage applies fn to batches of rows on multiple goroutines. It is
+// used for the steps that only look at one row at a time.
+type parallelStage struct {
+	input     rowIterator
+	workers   int
+	fn        func(first int, rows [][]Value) ([][]Value, error)
+	done      chan struct{}
+	closeOnce sync.Once
+	results   <-chan batchResult[[]Value]
+	current   [][]Value
+	pos       int
+}
+
+func newParallelStage(input rowIterator, workers int, fn func(first int, rows [][]Value) ([][]Value, error)) *parallelStage {
+	return &parallelStage{
+		input:   input,
+		workers: workers,
+		fn:      fn,
+		done:    make(chan struct{}),
+	}
+}
+
+func newParallelProjectionStage(input rowIterator, ops []Expression, workers int, step int) *parallelStage {
+	return newParallelStage(input, workers, func(first int, rows [][]Value) ([][]Value, error) {
+		res := make([][]Value, 0, len(rows))
+		for i, record := range rows {
+			row, ok, err := project(ops, record)
+			if err != nil {
+				return nil, rowError(step, first+i+1, err)
+			}
+			if ok {
+				res = append(res, row)
+			}
+		}
+		return res, nil
+	})
+}
+
+// newParallelParseStage parses the fields of rows read by a csvSource with
+// parseFields set to false.
+func newParallelParseStage(input rowIterator, workers int) *parallelStage {
+	return newParallelStage(input, workers, func(first int, rows [][]Value) ([][]Value, error) {
+		for _, record := range rows {
+			for j := range record {
+				record[j] = parseLiteral(record[j].value.(string)).value
+			}
+		}
+		return rows, nil
+	})
+}
+
+func (s *parallelStage) Next() ([]Value, error) {
+	if s.results == nil {
+		s.results = runOrdered(s.input, s.workers, s.done, s.fn)
+	}
+	for s.pos >= len(s.current) {
+		r, ok := <-s.results
+		if !ok {
+			return nil, io.EOF
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		s.current = r.items
+		s.pos = 0
+	}
+	row := s.current[s.pos]
+	s.pos++
+	return row, nil
+}
+
+func (s *parallelStage) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+type sequencedGroupRow struct {
+	seq int
+	row groupRow
+}
+
+// aggregateParallel evaluates the grouping and aggregating expressions on
+// multiple goroutines, and then partitions the rows by group between one
+// accumulator per worker. Since each accumulator receives all the rows of its
+// groups in input order, the result is the same as aggregating serially.
+func (s *groupStage) aggregateParallel(workers int) ([][]Value, error) {
+	done := make(chan struct{})
+	defer close(done)
+	results := runOrdered(s.input, workers, done, func(first int, rows [][]Value) ([]groupRow, error) {
+		res := make([]groupRow, len(rows))
+		for i, record := range rows {
+			row, err := evaluateGroupRow(s.groupOperations, record)
+			if err != nil {
+				return nil, rowError(s.step, first+i+1, err)
+			}
+			res[i] = row
+		}
+		return res, nil
+	})
+
+	accumulators := make([]*groupAccumulator, workers)
+	partitions := make([]chan []sequencedGroupRow, workers)
+	errs := make([]error, workers)
+	wg := sync.WaitGroup{}
+	for w := range accumulators {
+		accumulators[w] = newGroupAccumulator(s.groupOperations)
+		partitions[w] = make(chan []sequencedGroupRow, 4)
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for rows := range partitions[w] {
+				if errs[w] != nil {
+					continue
+				}
+				for _, r := range rows {
+					if err := accumulators[w].add(r.seq, r.row); err != nil {
+						errs[w] = err
+						break
+					}
+				}
+			}
+		}(w)
+	}
+
+	err := s.partitionGroupRows(results, partitions)
+	for _, p := range partitions {
+		close(p)
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mergeGroups(accumulators...), nil
+}
+
+func (s *groupStage) partitionGroupRows(results <-chan batchResult[groupRow], partitions []chan []sequencedGroupRow) error {
+	seed := maphash.MakeSeed()
+	seen := map[string]struct{}{}
+	groupLimitHit := false
+	seq := 0
+	for r := range results {
+		if r.err != nil {
+			return r.err
+		}
+		batches := make([][]sequencedGroupRow, len(partitions))
+		for _, row := range r.items {
+			seq++
+			if _, ok := seen[row.key]; !ok {
+				if s.options.MaxGroups > 0 && len(seen) >= s.options.MaxGroups {
+					if !groupLimitHit {
+						groupLimitHit = true
+						err := s.options.limitExceeded(&LimitError{Kind: LimitGroups, Max: s.options.MaxGroups, Step: s.step})
+						if err != nil {
+							return err
+						}
+					}
+					continue
+				}
+				seen[row.key] = struct{}{}
+			}
+			p := maphash.String(seed, row.key) % uint64(len(partitions))
+			batches[p] = append(batches[p], sequencedGroupRow{seq: seq, row: row})
+		}
+		for p, b := range batches {
+			if len(b) > 0 {
+				partitions[p] <- b
+			}
+		}
+	}
+	return nil
+}
@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"slices"
 	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/araddon/dateparse"
 )
@@ -28,27 +30,81 @@ var aggregationNames = []string{
 	"sum",
 }
 
+// parser holds the state of a query that is being parsed.
+type parser struct {
+	// macros are the bodies of the macros defined with def so far.
+	macros map[string][]Token
+	// expanding are the macros that are being expanded, used to detect
+	// macros that reference themselves.
+	expanding map[string]bool
+	// defs and uses record the macros that are defined and the expressions
+	// they expand to, so that Format can write the macros back.
+	defs []macroDef
+	uses map[Expression]string
+}
+
+type macroDef struct {
+	name  string
+	value Expression
+	pos   position
+}
+
+func newParser() *parser {
+	return &parser{
+		macros:    map[string][]Token{},
+		expanding: map[string]bool{},
+		uses:      map[Expression]string{},
+	}
+}
+
 func Parse(tokens []Token) (Expression, int, error) {
+	return newParser().parseExpr(tokens)
+}
+
+func (p *parser) parseExpr(tokens []Token) (Expression, int, error) {
 	if len(tokens) == 0 {
 		return nil, 0, nil
 	}
+	expr, consumed, err := p.parse(tokens)
+	if err != nil {
+		return nil, 0, diagnosticAt(tokenPosition(tokens[0]), err)
+	}
+	return expr, consumed, nil
+}
+
+func (p *parser) parse(tokens []Token) (Expression, int, error) {
 
 	tok := tokens[0]
 	consumed := 0
 
 	var head Expression = &Nop{}
-	if tok.Typ == TokenTypeString {
+	if body, ok := p.macros[strings.TrimSpace(tok.Str)]; ok && tok.Typ == TokenTypeString && (len(tokens) < 2 || tokens[1].Typ != TokenTypeLParen) {
+		expr, err := p.expandMacro(strings.TrimSpace(tok.Str), tokenPosition(tok), body)
+		if err != nil {
+			return nil, 0, err
+		}
+		p.uses[expr] = strings.TrimSpace(tok.Str)
+		head = expr
+		consumed++
+	} else if name, ok := parameterName(tok); ok {
+		head = &ParameterExpression{
+			name: name,
+			pos:  tokenPosition(tok),
+		}
+		consumed++
+	} else if tok.Typ == TokenTypeString {
 		literal := parseLiteral(tok.Str)
 		if literal == nil {
 			return nil, consumed, fmt.Errorf("failed to parse literal. string was: %v", tok.Str)
 		}
+		literal.source = tok.Str
 		head = literal
 		consumed++
 		tokens = tokens[consumed:]
 		if len(tokens) > 0 && tokens[0].Typ == TokenTypeLParen {
-			argList, consumed2, err := Parse(tokens)
+			argList, consumed2, err := p.parseExpr(tokens)
 			if err != nil {
-				return nil, 0, fmt.Errorf("failed to parse argument list for function call: %w", err)
+				return nil, 0, err
 			}
 			if argList.Type() != ExpressionExprList {
 				return nil, 0, fmt.Errorf("failed to parse function call: expected expression list but got: %v", argList)
@@ -62,78 +118,137 @@ func Parse(tokens []Token) (Expression, int, error) {
 				head = &AggregatingExpr{
 					aggregationName: tok.Str,
 					argument:        argList.(*ExpressionList).exprs[0],
+					argumentCount:   len(argList.(*ExpressionList).exprs),
+					pos:             tokenPosition(tok),
 				}
 			} else if tok.Str == "order" {
 				argListExprList := argList.(*ExpressionList)
-				argListLen := len(argListExprList.exprs)
-				if argListLen != 1 && argListLen != 2 {
-					return nil, 0, fmt.Errorf("order by requires one or two arguments, got: %d", len(argList.(*ExpressionList).exprs))
+				if len(argListExprList.exprs) < 1 {
+					return nil, 0, fmt.Errorf("order by requires at least one argument, got: %d", len(argListExprList.exprs))
 				}
-				head = &OrderingExpr{
-					argument:  argList.(*ExpressionList).exprs[0],
+				orderingExpr := &OrderingExpr{
+					argument:  argListExprList.exprs[0],
 					direction: OrderDirectionAsc,
 				}
-				if argListLen == 2 {
-					orderExpr := argList.(*ExpressionList).exprs[1]
+				for _, orderExpr := range argListExprList.exprs[1:] {
+					if orderExpr.Type() == ExpressionNop {
+						continue
+					}
 					if orderExpr.Type() != ExpressionLiteral {
-						return nil, 0, fmt.Errorf("order by direction must be a literal, got: %v", orderExpr)
+						return nil, 0, fmt.Errorf("order by options must be literals, got: %v", orderExpr)
 					}
 					litExpr := orderExpr.(*LiteralExpression)
 					if litExpr.value.typ != ValueTypeString {
-						return nil, 0, fmt.Errorf("order by direction must be a string literal, got: %v", orderExpr)
+						return nil, 0, fmt.Errorf("order by options must be string literals, got: %v", orderExpr)
+					}
+					if err := orderingExpr.setOption(litExpr.value.value.(string)); err != nil {
+						return nil, 0, err
 					}
-					switch litExpr.value.value {
-					case "desc":
-						head.(*OrderingExpr).direction = OrderDirectionDesc
-					case "asc":
-						head.(*OrderingExpr).direction = OrderDirectionAsc
-					default:
-						return nil, 0, fmt.Errorf("order by direction must be either 'asc' or 'desc', got: %v", litExpr.value.value)
+				}
+				head = orderingExpr
+			} else if tok.Str == "distinct" {
+				exprs := []Expression{}
+				for _, e := range argList.(*ExpressionList).exprs {
+					if e.Type() != ExpressionNop {
+						exprs = append(exprs, e)
 					}
 				}
+				head = &DistinctExpr{
+					arguments: ExpressionList{
+						exprs: exprs,
+					},
+				}
 			} else if tok.Str == "limit" {
-				argListExprList := argList.(*ExpressionList)
-				if len(argListExprList.exprs) != 1 {
-					return nil, 0, fmt.Errorf("limit requires exactly one argument, got: %d", len(argListExprList.exprs))
+				args, err := parseIntegerArguments("limit", argList.(*ExpressionList), 1, 2)
+				if err != nil {
+					return nil, 0, err
+				}
+				limitExpr := &LimitExpr{
+					limit: args[0],
 				}
-				if argListExprList.exprs[0].Type() != ExpressionLiteral {
-					return nil, 0, fmt.Errorf("limit argument must be a literal, got: %v", argListExprList.exprs[0])
+				if len(args) == 2 {
+					limitExpr.offset = args[1]
 				}
-				litExpr := argListExprList.exprs[0].(*LiteralExpression)
-				if litExpr.value.typ != ValueTypeInt {
-					return nil, 0, fmt.Errorf("limit argument must be an integer literal, got: %v", argListExprList.exprs[0])
+				head = limitExpr
+			} else if tok.Str == "tail" {
+				args, err := parseIntegerArguments("tail", argList.(*ExpressionList), 1, 1)
+				if err != nil {
+					return nil, 0, err
 				}
-				head = &LimitExpr{
-					limit: litExpr.value.value.(int64),
+				head = &TailExpr{
+					n: args[0],
 				}
+			} else if tok.Str == "sample" {
+				args, err := parseIntegerArguments("sample", argList.(*ExpressionList), 1, 2)
+				if err != nil {
+					return nil, 0, err
+				}
+				sampleExpr := &SampleExpr{
+					n: args[0],
+				}
+				if len(args) == 2 {
+					sampleExpr.seed = args[1]
+					sampleExpr.seeded = true
+				}
+				head = sampleExpr
+			} else if tok.Str == "pivot" {
+				pivotExpr, err := parsePivotExpr(argList.(*ExpressionList))
+				if err != nil {
+					return nil, 0, err
+				}
+				head = pivotExpr
+			} else if tok.Str == "unpivot" {
+				unpivotExpr, err := parseUnpivotExpr(argList.(*ExpressionList))
+				if err != nil {
+					return nil, 0, err
+				}
+				head = unpivotExpr
+			} else if tok.Str == "where" || tok.Str == "keep" {
+				exprs := argList.(*ExpressionList).exprs
+				if len(exprs) != 1 {
+					return nil, 0, fmt.Errorf("%v requires exactly 1 argument, got: %d", tok.Str, len(exprs))
+				}
+				if tok.Str == "where" {
+					head = &WhereExpr{
+						inner: exprs[0],
+					}
+				} else {
+					head = &KeepExpr{
+						inner: exprs[0],
+					}
+				}
+			} else if tok.Str == "join" {
+				joinExpr, err := parseJoinExpr(argList.(*ExpressionList))
+				if err != nil {
+					return nil, 0, err
+				}
+				head = joinExpr
+			} else if slices.Contains(windowFunctionNames, tok.Str) {
+				windowExpr, err := parseWindowExpr(tok.Str, argList.(*ExpressionList))
+				if err != nil {
+					return nil, 0, err
+				}
+				head = windowExpr
 			} else {
 				head = &Funcall{
 					funcName:  tok.Str,
 					arguments: *argList.(*ExpressionList),
+					pos:       tokenPosition(tok),
 				}
 			}
 		}
 	} else if tok.Typ == TokenTypeOperator {
 		if tok.Str == "$" {
-			if len(tokens) < 1 {
-				return nil, consumed, fmt.Errorf("not enough tokens, expected at least 1 after $ operator")
-			}
-			nextTok := tokens[1]
-			if nextTok.Typ != TokenTypeString {
-				return nil, consumed, fmt.Errorf("expected string token after $ operator")
-			}
-			index, err := strconv.ParseInt(nextTok.Str, 10, 32)
+			ref, consumed2, err := parseColumnReference(tokens)
 			if err != nil {
-				return nil, consumed, fmt.Errorf("failed to parse column reference to int. string was: %v", nextTok.Str)
-			}
-			head = &ColumnReferenceExpression{
-				index: int(index),
+				return nil, consumed, err
 			}
-			consumed += 2
+			head = ref
+			consumed += consumed2
 		} else if tok.Str == "=" {
 			consumed += 1
 			tokens = tokens[1:]
-			rhs, consumed2, err := Parse(tokens)
+			rhs, consumed2, err := p.parseExpr(tokens)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -144,7 +259,7 @@ func Parse(tokens []Token) (Expression, int, error) {
 		} else if tok.Str == "<" {
 			consumed += 1
 			tokens = tokens[1:]
-			rhs, consumed2, err := Parse(tokens)
+			rhs, consumed2, err := p.parseExpr(tokens)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -155,7 +270,7 @@ func Parse(tokens []Token) (Expression, int, error) {
 		} else if tok.Str == ">" {
 			consumed += 1
 			tokens = tokens[1:]
-			rhs, consumed2, err := Parse(tokens)
+			rhs, consumed2, err := p.parseExpr(tokens)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -166,7 +281,7 @@ func Parse(tokens []Token) (Expression, int, error) {
 		} else if tok.Str == "!" {
 			consumed += 1
 			tokens = tokens[1:]
-			inner, consumed2, err := Parse(tokens)
+			inner, consumed2, err := p.parseExpr(tokens)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -177,7 +292,7 @@ func Parse(tokens []Token) (Expression, int, error) {
 		} else if tok.Str == "+" {
 			consumed += 1
 			tokens = tokens[1:]
-			rhs, consumed2, err := Parse(tokens)
+			rhs, consumed2, err := p.parseExpr(tokens)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -188,7 +303,7 @@ func Parse(tokens []Token) (Expression, int, error) {
 		} else if tok.Str == "-" {
 			consumed += 1
 			tokens = tokens[1:]
-			rhs, consumed2, err := Parse(tokens)
+			rhs, consumed2, err := p.parseExpr(tokens)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -199,7 +314,7 @@ func Parse(tokens []Token) (Expression, int, error) {
 		} else if tok.Str == "*" {
 			consumed += 1
 			tokens = tokens[1:]
-			rhs, consumed2, err := Parse(tokens)
+			rhs, consumed2, err := p.parseExpr(tokens)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -210,7 +325,7 @@ func Parse(tokens []Token) (Expression, int, error) {
 		} else if tok.Str == "/" {
 			consumed += 1
 			tokens = tokens[1:]
-			rhs, consumed2, err := Parse(tokens)
+			rhs, consumed2, err := p.parseExpr(tokens)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -226,7 +341,7 @@ func Parse(tokens []Token) (Expression, int, error) {
 		consumed += 1
 		tokens = tokens[1:]
 		for {
-			arg, consumed2, err := Parse(tokens)
+			arg, consumed2, err := p.parseExpr(tokens)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -240,16 +355,21 @@ func Parse(tokens []Token) (Expression, int, error) {
 			consumed += consumed2
 			tokens = tokens[consumed2:]
 			if len(tokens) == 0 {
-				return nil, 0, fmt.Errorf("failed to parse expression list: expected right paren but ran out of tokens")
+				return nil, 0, fmt.Errorf("expected ')' but the query ended")
 			}
 			if tokens[0].Typ == TokenTypeRParen {
 				consumed += 1
 				break
 			}
-			if tokens[0].Typ == TokenTypeComma {
-				consumed += 1
-				tokens = tokens[1:]
+			// An operator continues the current argument as a binary expression.
+			if tokens[0].Typ == TokenTypeOperator {
+				continue
+			}
+			if tokens[0].Typ != TokenTypeComma {
+				return nil, 0, newDiagnostic(tokenPosition(tokens[0]), "expected ',' or ')' but got %v", describeToken(tokens[0]))
 			}
+			consumed += 1
+			tokens = tokens[1:]
 		}
 		head = &ExpressionList{
 			exprs: exprs,
@@ -260,35 +380,37 @@ func Parse(tokens []Token) (Expression, int, error) {
 }
 
 func ParseLine(tokens []Token) ([]Expression, int, error) {
+	return newParser().parseLine(tokens)
+}
+
+func (p *parser) parseLine(tokens []Token) ([]Expression, int, error) {
 	res := []Expression{}
 	columnIdx := 0
 	consumed := 0
 	for len(tokens) > 0 {
-		expr, consumed2, err := Parse(tokens)
+		// A ? before an operation marks it as a filter.
+		isFilter := false
+		if tokens[0].Typ == TokenTypeOperator && tokens[0].Str == "?" {
+			isFilter = true
+			consumed++
+			tokens = tokens[1:]
+		}
+
+		expr, consumed2, err := p.parseOperation(tokens)
 		if err != nil {
 			return nil, 0, err
 		}
 		consumed += consumed2
 		tokens = tokens[consumed2:]
 
-		if len(tokens) > 0 && tokens[0].Typ == TokenTypeOperator {
-			expr2, consumed2, err := Parse(tokens)
-			if err != nil {
-				return nil, 0, err
-			}
-
-			if b, ok := expr2.(BinaryExpr); ok {
-				b.SetLHS(expr)
-				expr = expr2
-			} else {
-				return nil, 0, fmt.Errorf("expected binary expression but got: %v", expr2)
+		if isFilter {
+			expr = &WhereExpr{
+				inner: expr,
 			}
-
-			consumed += consumed2
-			tokens = tokens[consumed2:]
 		}
 		expr.FillNils(&ColumnReferenceExpression{
-			index: columnIdx,
+			index:    columnIdx,
+			implicit: true,
 		})
 		res = append(res, expr)
 
@@ -297,7 +419,7 @@ func ParseLine(tokens []Token) ([]Expression, int, error) {
 				return res, consumed, nil
 			}
 			if tokens[0].Typ != TokenTypeComma {
-				return nil, 0, fmt.Errorf("unexpected token type, expected comma but got: %v", tokens[0])
+				return nil, 0, newDiagnostic(tokenPosition(tokens[0]), "expected ',' but got %v", describeToken(tokens[0]))
 			}
 			columnIdx++
 			consumed += 1
@@ -307,25 +429,345 @@ func ParseLine(tokens []Token) ([]Expression, int, error) {
 	return res, consumed, nil
 }
 
+// parseOperation parses an operation, which is an expression optionally
+// followed by a binary operator and its right hand side.
+func (p *parser) parseOperation(tokens []Token) (Expression, int, error) {
+	expr, consumed, err := p.parseExpr(tokens)
+	if err != nil {
+		return nil, 0, err
+	}
+	tokens = tokens[consumed:]
+
+	if len(tokens) > 0 && tokens[0].Typ == TokenTypeOperator {
+		expr2, consumed2, err := p.parseExpr(tokens)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if b, ok := expr2.(BinaryExpr); ok {
+			b.SetLHS(expr)
+			expr = expr2
+		} else {
+			return nil, 0, newDiagnostic(tokenPosition(tokens[0]), "expected binary expression but got: %v", expr2)
+		}
+		consumed += consumed2
+	}
+	return expr, consumed, nil
+}
+
 func ParseQuery(tokens []Token) ([][]Expression, error) {
+	res, _, err := newParser().parseQuery(tokens)
+	return res, err
+}
+
+// parseQuery parses a query and returns the position where each step starts
+// along with the steps.
+func (p *parser) parseQuery(tokens []Token) ([][]Expression, []position, error) {
 	res := [][]Expression{}
+	positions := []position{}
 	for len(tokens) > 0 {
-		exprs, consumed, err := ParseLine(tokens)
+		pos := tokenPosition(tokens[0])
+		var exprs []Expression
+		var consumed int
+		var err error
+		if isAssignment("def", tokens) {
+			consumed, err = p.parseDef(tokens)
+		} else if isAssignment("let", tokens) {
+			exprs, consumed, err = p.parseLet(tokens)
+		} else {
+			exprs, consumed, err = p.parseLine(tokens)
+		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if exprs != nil {
+			res = append(res, exprs)
+			positions = append(positions, pos)
 		}
-		res = append(res, exprs)
 		tokens = tokens[consumed:]
 		if len(tokens) > 0 {
 			if tokens[0].Typ != TokenTypeNewLine {
-				return nil, fmt.Errorf("unexpected token type, expected new line but got: %v", tokens[0])
+				return nil, nil, newDiagnostic(tokenPosition(tokens[0]), "expected new line but got %v", describeToken(tokens[0]))
 			}
 			tokens = tokens[1:]
 		}
 	}
+	return res, positions, nil
+}
+
+// parseIntegerArguments parses the arguments of operations like limit, which
+// only accept non-negative integer literals.
+func parseIntegerArguments(name string, argList *ExpressionList, minArgs, maxArgs int) ([]int64, error) {
+	exprs := argList.exprs
+	if len(exprs) < minArgs || len(exprs) > maxArgs {
+		if minArgs == maxArgs {
+			return nil, fmt.Errorf("%v requires exactly %d argument(s), got: %d", name, minArgs, len(exprs))
+		}
+		return nil, fmt.Errorf("%v requires between %d and %d arguments, got: %d", name, minArgs, maxArgs, len(exprs))
+	}
+	res := make([]int64, len(exprs))
+	for i, e := range exprs {
+		if e.Type() != ExpressionLiteral {
+			return nil, fmt.Errorf("%v argument must be a literal, got: %v", name, e)
+		}
+		litExpr := e.(*LiteralExpression)
+		if litExpr.value.typ != ValueTypeInt {
+			return nil, fmt.Errorf("%v argument must be an integer literal, got: %v", name, e)
+		}
+		res[i] = litExpr.value.value.(int64)
+		if res[i] < 0 {
+			return nil, fmt.Errorf("%v argument cannot be negative, got: %d", name, res[i])
+		}
+	}
 	return res, nil
 }
 
+// parseColumnReference parses a column reference starting at a $ token. This
+// is either a single column like $2 or $-1, all columns $*, or a range like
+// $2..$5. Columns can be excluded from $* and ranges with !, as in $*!$3.
+func parseColumnReference(tokens []Token) (Expression, int, error) {
+	consumed := 1
+	var head Expression
+	if len(tokens) > 1 && tokens[1].Typ == TokenTypeOperator && tokens[1].Str == "*" {
+		head = &ColumnRangeExpression{
+			all: true,
+		}
+		consumed++
+	} else {
+		from, isRange, consumed2, err := parseColumnIndex(tokens[consumed:])
+		if err != nil {
+			return nil, 0, err
+		}
+		consumed += consumed2
+		if !isRange {
+			return &ColumnReferenceExpression{
+				index: from,
+			}, consumed, nil
+		}
+		if len(tokens) <= consumed || tokens[consumed].Typ != TokenTypeOperator || tokens[consumed].Str != "$" {
+			return nil, 0, fmt.Errorf("expected column reference after .. in column range")
+		}
+		consumed++
+		to, isRange, consumed2, err := parseColumnIndex(tokens[consumed:])
+		if err != nil {
+			return nil, 0, err
+		}
+		if isRange {
+			return nil, 0, fmt.Errorf("expected column reference after .. in column range")
+		}
+		consumed += consumed2
+		if (from >= 0) == (to >= 0) && to < from {
+			return nil, 0, fmt.Errorf("invalid column range: $%d..$%d", from, to)
+		}
+		head = &ColumnRangeExpression{
+			from: from,
+			to:   to,
+		}
+	}
+
+	rangeExpr := head.(*ColumnRangeExpression)
+	for len(tokens) > consumed+1 && tokens[consumed].Typ == TokenTypeOperator && tokens[consumed].Str == "!" &&
+		tokens[consumed+1].Typ == TokenTypeOperator && tokens[consumed+1].Str == "$" {
+		exclude, consumed2, err := parseColumnReference(tokens[consumed+1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		rangeExpr.exclude = append(rangeExpr.exclude, exclude)
+		consumed += 1 + consumed2
+	}
+	return head, consumed, nil
+}
+
+// parseColumnIndex parses the index after a $, which may be negative. It
+// returns true if the index is followed by .. and so starts a range.
+func parseColumnIndex(tokens []Token) (int, bool, int, error) {
+	consumed := 0
+	sign := int64(1)
+	if len(tokens) > 0 && tokens[0].Typ == TokenTypeOperator && tokens[0].Str == "-" {
+		sign = -1
+		consumed++
+	}
+	if len(tokens) <= consumed {
+		return 0, false, 0, fmt.Errorf("not enough tokens, expected at least 1 after $ operator")
+	}
+	tok := tokens[consumed]
+	if tok.Typ != TokenTypeString {
+		return 0, false, 0, fmt.Errorf("expected string token after $ operator")
+	}
+	str, isRange := strings.CutSuffix(tok.Str, "..")
+	index, err := strconv.ParseInt(str, 10, 32)
+	if err != nil {
+		return 0, false, 0, fmt.Errorf("failed to parse column reference to int. string was: %v", tok.Str)
+	}
+	return int(sign * index), isRange, consumed + 1, nil
+}
+
+func parsePivotExpr(argList *ExpressionList) (*PivotExpr, error) {
+	exprs := argList.exprs
+	if len(exprs) != 3 {
+		return nil, fmt.Errorf("pivot requires exactly 3 arguments, got: %d", len(exprs))
+	}
+	aggregate, ok := exprs[2].(*AggregatingExpr)
+	if f, isFuncall := exprs[2].(*Funcall); isFuncall && len(f.arguments.exprs) > 0 {
+		// This may be an aggregation registered with an Engine, which is
+		// checked when the query is bound.
+		aggregate, ok = &AggregatingExpr{
+			aggregationName: f.funcName,
+			argument:        f.arguments.exprs[0],
+			argumentCount:   len(f.arguments.exprs),
+			pos:             f.pos,
+		}, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("pivot requires an aggregating expression as its third argument, got: %v", exprs[2])
+	}
+	return &PivotExpr{
+		rowKey:    exprs[0],
+		colKey:    exprs[1],
+		aggregate: aggregate,
+	}, nil
+}
+
+func parseUnpivotExpr(argList *ExpressionList) (*UnpivotExpr, error) {
+	unpivotExpr := &UnpivotExpr{}
+	for _, e := range argList.exprs {
+		switch e.Type() {
+		case ExpressionNop:
+			continue
+		case ExpressionColumnReference, ExpressionColumnRange:
+			unpivotExpr.columns = append(unpivotExpr.columns, e)
+		case ExpressionLiteral:
+			if e.(*LiteralExpression).value.String() != "header" {
+				return nil, fmt.Errorf("unknown unpivot option: %v", e)
+			}
+			unpivotExpr.header = true
+		default:
+			return nil, fmt.Errorf("unpivot arguments must be column references, got: %v", e)
+		}
+	}
+	if len(unpivotExpr.columns) == 0 {
+		return nil, fmt.Errorf("unpivot requires at least one column")
+	}
+	return unpivotExpr, nil
+}
+
+func parseJoinExpr(argList *ExpressionList) (*JoinExpr, error) {
+	exprs := argList.exprs
+	if len(exprs) < 3 || len(exprs) > 4 {
+		return nil, fmt.Errorf("join requires between 3 and 4 arguments, got: %d", len(exprs))
+	}
+	source, ok := exprs[0].(*LiteralExpression)
+	if !ok {
+		return nil, fmt.Errorf("join source must be a file name, got: %v", exprs[0])
+	}
+	joinExpr := &JoinExpr{
+		source:   source.value.String(),
+		leftKey:  exprs[1],
+		rightKey: exprs[2],
+		joinType: JoinTypeInner,
+	}
+	if len(exprs) == 4 && exprs[3].Type() != ExpressionNop {
+		litExpr, ok := exprs[3].(*LiteralExpression)
+		if !ok {
+			return nil, fmt.Errorf("join type must be a literal, got: %v", exprs[3])
+		}
+		switch litExpr.value.String() {
+		case "inner":
+			joinExpr.joinType = JoinTypeInner
+		case "left":
+			joinExpr.joinType = JoinTypeLeft
+		case "anti":
+			joinExpr.joinType = JoinTypeAnti
+		default:
+			return nil, fmt.Errorf("unknown join type: %v", litExpr.value.String())
+		}
+	}
+	return joinExpr, nil
+}
+
+// parseWindowExpr parses the arguments of a window function. The partition
+// key is given as a trailing over(...) argument, for example cumsum($1,over($0)).
+func parseWindowExpr(name string, argList *ExpressionList) (*WindowExpr, error) {
+	windowExpr := &WindowExpr{
+		funcName: name,
+	}
+	args := []Expression{}
+	hasPartition := false
+	for i, e := range argList.exprs {
+		if f, ok := e.(*Funcall); ok && f.funcName == "over" {
+			if hasPartition {
+				return nil, fmt.Errorf("%v can only have one over argument", name)
+			}
+			hasPartition = true
+			for _, p := range f.arguments.exprs {
+				if p.Type() != ExpressionNop {
+					windowExpr.partition.exprs = append(windowExpr.partition.exprs, p)
+				}
+			}
+			continue
+		}
+		// A missing first argument is filled with an implicit column
+		// reference, but missing arguments after it are ignored.
+		if i > 0 && e.Type() == ExpressionNop {
+			continue
+		}
+		args = append(args, e)
+	}
+
+	switch name {
+	case "rownum":
+		if len(args) > 1 || (len(args) == 1 && args[0].Type() != ExpressionNop) {
+			return nil, fmt.Errorf("rownum does not take any arguments except over, got: %v", args)
+		}
+	case "rank":
+		if len(args) < 1 {
+			return nil, fmt.Errorf("rank requires at least one argument, got: 0")
+		}
+		windowExpr.order = &OrderingExpr{
+			argument:  args[0],
+			direction: OrderDirectionAsc,
+		}
+		for _, e := range args[1:] {
+			litExpr, ok := e.(*LiteralExpression)
+			if !ok || litExpr.value.typ != ValueTypeString {
+				return nil, fmt.Errorf("rank options must be string literals, got: %v", e)
+			}
+			if err := windowExpr.order.setOption(litExpr.value.value.(string)); err != nil {
+				return nil, err
+			}
+		}
+	case "cumsum":
+		if len(args) > 1 {
+			return nil, fmt.Errorf("cumsum requires exactly 1 argument, got: %d", len(args))
+		}
+		windowExpr.argument = &Nop{}
+		if len(args) == 1 {
+			windowExpr.argument = args[0]
+		}
+	case "lag", "lead", "movavg":
+		minArgs := 0
+		windowExpr.n = 1
+		if name == "movavg" {
+			minArgs = 1
+		}
+		if len(args) < 1 {
+			return nil, fmt.Errorf("%v requires at least one argument, got: 0", name)
+		}
+		windowExpr.argument = args[0]
+		n, err := parseIntegerArguments(name, &ExpressionList{exprs: args[1:]}, minArgs, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(n) == 1 {
+			windowExpr.n = n[0]
+		}
+		if name == "movavg" && windowExpr.n == 0 {
+			return nil, fmt.Errorf("movavg requires a window of at least 1 row")
+		}
+	}
+	return windowExpr, nil
+}
+
 func parseLiteral(str string) *LiteralExpression {
 	if str == "true" {
 		return &LiteralExpression{
@@ -372,3 +814,125 @@ func parseLiteral(str string) *LiteralExpression {
 		}
 	}
 }
+
+// parameterName returns the name of a :name parameter token.
+func parameterName(tok Token) (string, bool) {
+	str := strings.TrimSpace(tok.Str)
+	if tok.Typ != TokenTypeString || !strings.HasPrefix(str, ":") {
+		return "", false
+	}
+	name := str[1:]
+	return name, isIdentifier(name)
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if c != '_' && !unicode.IsLetter(c) && (i == 0 || !unicode.IsDigit(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAssignment returns true if a step is of the form keyword name = value,
+// which is used by let and def.
+func isAssignment(keyword string, tokens []Token) bool {
+	return len(tokens) >= 2 &&
+		tokens[0].Typ == TokenTypeString &&
+		strings.HasPrefix(strings.TrimSpace(tokens[0].Str), keyword+" ") &&
+		tokens[1].Typ == TokenTypeOperator &&
+		tokens[1].Str == "="
+}
+
+// parseAssignment returns the name and the tokens of the value of a let or
+// def step, and the number of tokens in the step.
+func parseAssignment(keyword string, tokens []Token) (string, []Token, int, error) {
+	name := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(tokens[0].Str), keyword+" "))
+	if !isIdentifier(name) {
+		return "", nil, 0, newDiagnostic(tokenPosition(tokens[0]), "invalid name in %v: %q", keyword, name)
+	}
+	end := slices.IndexFunc(tokens, func(tok Token) bool {
+		return tok.Typ == TokenTypeNewLine
+	})
+	if end == -1 {
+		end = len(tokens)
+	}
+	value := tokens[2:end]
+	// The spaces around = are not part of the value.
+	if len(value) > 0 && value[0].Typ == TokenTypeString {
+		trimmed := strings.TrimLeft(value[0].Str, " \t")
+		if trimmed == "" {
+			value = value[1:]
+		} else {
+			value = slices.Clone(value)
+			value[0].Col += len([]rune(value[0].Str)) - len([]rune(trimmed))
+			value[0].Str = trimmed
+		}
+	}
+	if len(value) == 0 {
+		return "", nil, 0, newDiagnostic(tokenPosition(tokens[1]), "%v %v requires a value", keyword, name)
+	}
+	return name, value, end, nil
+}
+
+func (p *parser) parseLet(tokens []Token) ([]Expression, int, error) {
+	name, value, consumed, err := parseAssignment("let", tokens)
+	if err != nil {
+		return nil, 0, err
+	}
+	exprs, _, err := p.parseLine(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(exprs) != 1 {
+		return nil, 0, newDiagnostic(tokenPosition(value[0]), "let %v requires a single value, got: %d", name, len(exprs))
+	}
+	return []Expression{&LetExpr{
+		name:  name,
+		value: exprs[0],
+		pos:   tokenPosition(tokens[0]),
+	}}, consumed, nil
+}
+
+// parseDef defines a macro. The value of the macro is parsed again each time
+// the macro is used, so that every use gets its own expression.
+func (p *parser) parseDef(tokens []Token) (int, error) {
+	name, value, consumed, err := parseAssignment("def", tokens)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := p.macros[name]; ok {
+		return 0, newDiagnostic(tokenPosition(tokens[0]), "%v is already defined", name)
+	}
+	expr, err := p.expandMacro(name, tokenPosition(tokens[0]), value)
+	if err != nil {
+		return 0, err
+	}
+	p.macros[name] = value
+	p.defs = append(p.defs, macroDef{
+		name:  name,
+		value: expr,
+		pos:   tokenPosition(tokens[0]),
+	})
+	return consumed, nil
+}
+
+// expandMacro parses the value of a macro that is used at pos.
+func (p *parser) expandMacro(name string, pos position, value []Token) (Expression, error) {
+	if p.expanding[name] {
+		return nil, newDiagnostic(pos, "%v references itself", name)
+	}
+	p.expanding[name] = true
+	defer delete(p.expanding, name)
+	expr, consumed, err := p.parseOperation(value)
+	if err != nil {
+		return nil, err
+	}
+	if consumed != len(value) {
+		return nil, newDiagnostic(tokenPosition(value[consumed]), "expected a single expression but got %v", describeToken(value[consumed]))
+	}
+	return expr, nil
+}
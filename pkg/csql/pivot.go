@@ -0,0 +1,169 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"fmt"
+	"io"
+	"slices"
+)
+
+// pivotStage groups the rows by the row and column keys of a pivot, and then
+// spreads the aggregated values of each row key out over the column keys.
+// The first row returned is a header with the column keys.
+type pivotStage struct {
+	groups *groupStage
+	output *sliceIterator
+}
+
+func newPivotStage(input rowIterator, pivotExpr *PivotExpr, options *Options, step int) *pivotStage {
+	return &pivotStage{
+		groups: &groupStage{
+			input: input,
+			groupOperations: GroupOperations{
+				groupExpr: &GroupingExpr{
+					arguments: ExpressionList{
+						exprs: []Expression{pivotExpr.rowKey, pivotExpr.colKey},
+					},
+				},
+				projectionExprs: []*AggregatingExpr{pivotExpr.aggregate},
+			},
+			options: options,
+			step:    step,
+		},
+	}
+}
+
+func (s *pivotStage) Next() ([]Value, error) {
+	if s.output == nil {
+		rows, err := s.pivot()
+		if err != nil {
+			return nil, err
+		}
+		s.output = &sliceIterator{rows: rows}
+	}
+	return s.output.Next()
+}
+
+func (s *pivotStage) pivot() ([][]Value, error) {
+	header := []Value{{typ: ValueTypeString, value: ""}}
+	columns := map[string]int{}
+	rows := [][]Value{}
+	rowIndexes := map[string]int{}
+	for {
+		// Each group is the row key, the column key and the aggregated value.
+		group, err := s.groups.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rk := rowKey(group[:1])
+		r, ok := rowIndexes[rk]
+		if !ok {
+			r = len(rows)
+			rowIndexes[rk] = r
+			rows = append(rows, []Value{group[0]})
+		}
+		colKey := rowKey(group[1:2])
+		c, ok := columns[colKey]
+		if !ok {
+			c = len(header)
+			columns[colKey] = c
+			header = append(header, Value{typ: ValueTypeString, value: group[1].String()})
+		}
+		for len(rows[r]) <= c {
+			rows[r] = append(rows[r], Value{})
+		}
+		rows[r][c] = group[2]
+	}
+	for r := range rows {
+		for len(rows[r]) < len(header) {
+			rows[r] = append(rows[r], Value{})
+		}
+	}
+	return append([][]Value{header}, rows...), nil
+}
+
+// unpivotStage turns each row into one row for each unpivoted column, with
+// the columns that are not unpivoted followed by the name and value of the
+// unpivoted column.
+type unpivotStage struct {
+	input       rowIterator
+	unpivotExpr *UnpivotExpr
+	names       []Value
+	pending     [][]Value
+	read        int
+}
+
+func (s *unpivotStage) Next() ([]Value, error) {
+	for len(s.pending) == 0 {
+		record, err := s.input.Next()
+		if err != nil {
+			return nil, err
+		}
+		s.read++
+		if s.unpivotExpr.header && s.names == nil {
+			s.names = record
+			continue
+		}
+		if err := s.unpivot(record); err != nil {
+			return nil, err
+		}
+	}
+	row := s.pending[0]
+	s.pending = s.pending[1:]
+	return row, nil
+}
+
+func (s *unpivotStage) unpivot(record []Value) error {
+	indexes := []int{}
+	for _, c := range s.unpivotExpr.columns {
+		switch c := c.(type) {
+		case *ColumnReferenceExpression:
+			idx, ok := c.resolve(len(record))
+			if !ok {
+				return fmt.Errorf("unpivot: row %d: %w", s.read, columnOutOfRange(c.index, len(record)))
+			}
+			indexes = append(indexes, idx)
+		case *ColumnRangeExpression:
+			rangeIndexes, err := c.indexes(len(record))
+			if err != nil {
+				return fmt.Errorf("unpivot: row %d: %w", s.read, err)
+			}
+			indexes = append(indexes, rangeIndexes...)
+		}
+	}
+	kept := []Value{}
+	for i, v := range record {
+		if !slices.Contains(indexes, i) {
+			kept = append(kept, v)
+		}
+	}
+	for _, idx := range indexes {
+		name := Value{typ: ValueTypeString, value: fmt.Sprintf("$%d", idx)}
+		if idx < len(s.names) {
+			name = s.names[idx]
+		}
+		row := make([]Value, len(kept), len(kept)+2)
+		copy(row, kept)
+		row = append(row, name, record[idx])
+		s.pending = append(s.pending, row)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// printer writes expressions in the syntax they are parsed from.
+type printer struct {
+	// explicit is true if implicit column references are written out.
+	explicit bool
+	// implicit are the implicit column references that have been printed.
+	implicit []int
+	// macros are the expressions that are written as the name of the macro
+	// they were expanded from.
+	macros map[Expression]string
+}
+
+// operation returns an operation of a step as it would be written in a query.
+func (p *printer) operation(e Expression) string {
+	switch e := e.(type) {
+	case *WhereExpr:
+		return "?" + p.expr(e.inner)
+	case *LetExpr:
+		return fmt.Sprintf("let %v = %v", e.name, p.expr(e.value))
+	}
+	return p.expr(e)
+}
+
+func (p *printer) expr(e Expression) string {
+	if name, ok := p.macros[e]; ok {
+		return name
+	}
+	if lhs, op, rhs, ok := binaryOperands(e); ok {
+		return p.expr(lhs) + op + p.operand(rhs)
+	}
+	switch e := e.(type) {
+	case nil, *Nop:
+		return ""
+	case *LiteralExpression:
+		if e.source != "" {
+			return e.source
+		}
+		return e.value.String()
+	case *ParameterExpression:
+		return ":" + e.name
+	case *ColumnReferenceExpression:
+		if e.implicit {
+			p.implicit = append(p.implicit, e.index)
+			if !p.explicit {
+				return ""
+			}
+		}
+		return "$" + strconv.Itoa(e.index)
+	case *ColumnRangeExpression:
+		res := "$*"
+		if !e.all {
+			res = fmt.Sprintf("$%d..$%d", e.from, e.to)
+		}
+		for _, x := range e.exclude {
+			res += "!" + p.expr(x)
+		}
+		return res
+	case *OpNeg:
+		return "!" + p.operand(e.inner)
+	case *ExpressionList:
+		return p.list(e.exprs...)
+	case *Funcall:
+		args := e.arguments.exprs
+		if fn, ok := e.resolved(); ok && p.explicit && e.implicit != nil && !fn.variadic && len(args) < len(fn.argumentTypes) {
+			// The implicit column reference is the first argument when the
+			// query is bound.
+			args = append([]Expression{e.implicit}, args...)
+		}
+		return p.call(e.funcName, args...)
+	case *GroupingExpr:
+		return p.call("group", e.arguments.exprs...)
+	case *AggregatingExpr:
+		return p.call(e.aggregationName, e.argument)
+	case *OrderingExpr:
+		return fmt.Sprintf("order(%v%v)", p.expr(e.argument), orderOptions(e, ","))
+	case *LimitExpr:
+		if e.offset != 0 {
+			return fmt.Sprintf("limit(%d,%d)", e.limit, e.offset)
+		}
+		return fmt.Sprintf("limit(%d)", e.limit)
+	case *TailExpr:
+		return fmt.Sprintf("tail(%d)", e.n)
+	case *SampleExpr:
+		if e.seeded {
+			return fmt.Sprintf("sample(%d,%d)", e.n, e.seed)
+		}
+		return fmt.Sprintf("sample(%d)", e.n)
+	case *DistinctExpr:
+		return p.call("distinct", e.arguments.exprs...)
+	case *WindowExpr:
+		return p.window(e)
+	case *JoinExpr:
+		res := fmt.Sprintf("join(%v,%v,%v", e.source, p.expr(e.leftKey), p.expr(e.rightKey))
+		switch e.joinType {
+		case JoinTypeLeft:
+			res += ",left"
+		case JoinTypeAnti:
+			res += ",anti"
+		}
+		return res + ")"
+	case *PivotExpr:
+		return p.call("pivot", e.rowKey, e.colKey, e.aggregate)
+	case *UnpivotExpr:
+		res := "unpivot(" + p.list(e.columns...)
+		if e.header {
+			res += ",header"
+		}
+		return res + ")"
+	case *WhereExpr:
+		return p.call("where", e.inner)
+	case *KeepExpr:
+		return p.call("keep", e.inner)
+	case *LetExpr:
+		return p.operation(e)
+	}
+	return fmt.Sprint(e)
+}
+
+// operand returns the right hand side of a binary operator or the operand of
+// !. A binary expression in this position can only be written with an
+// implicit left hand side, as in !=ABC, since there are no parentheses.
+func (p *printer) operand(e Expression) string {
+	if _, ok := p.macros[e]; ok {
+		return p.expr(e)
+	}
+	if lhs, op, rhs, ok := binaryOperands(e); ok {
+		if ref, ok := lhs.(*ColumnReferenceExpression); ok && ref.implicit {
+			p.implicit = append(p.implicit, ref.index)
+			return op + p.operand(rhs)
+		}
+	}
+	return p.expr(e)
+}
+
+func (p *printer) call(name string, args ...Expression) string {
+	return name + "(" + p.list(args...) + ")"
+}
+
+func (p *printer) list(exprs ...Expression) string {
+	strs := make([]string, len(exprs))
+	for i, e := range exprs {
+		strs[i] = p.expr(e)
+	}
+	return strings.Join(strs, ",")
+}
+
+func (p *printer) window(e *WindowExpr) string {
+	args := []string{}
+	switch e.funcName {
+	case "rank":
+		args = append(args, p.expr(e.order.argument)+orderOptions(e.order, ","))
+	case "cumsum":
+		args = append(args, p.expr(e.argument))
+	case "lag", "lead", "movavg":
+		args = append(args, p.expr(e.argument))
+		if e.n != 1 || e.funcName == "movavg" {
+			args = append(args, strconv.FormatInt(e.n, 10))
+		}
+	}
+	if len(e.partition.exprs) > 0 {
+		args = append(args, p.call("over", e.partition.exprs...))
+	}
+	return e.funcName + "(" + strings.Join(args, ",") + ")"
+}
+
+// orderOptions returns the options of an ordering that are not the default,
+// each preceded by sep.
+func orderOptions(e *OrderingExpr, sep string) string {
+	res := ""
+	if e.direction == OrderDirectionDesc {
+		res += sep + "desc"
+	}
+	switch e.nulls {
+	case NullsFirst:
+		res += sep + "nulls first"
+	case NullsLast:
+		res += sep + "nulls last"
+	}
+	switch e.collation {
+	case CollationNoCase:
+		res += sep + "nocase"
+	case CollationNatural:
+		res += sep + "natural"
+	}
+	return res
+}
+
+// binaryOperands returns the operands and the operator of a binary
+// expression.
+func binaryOperands(e Expression) (Expression, string, Expression, bool) {
+	switch e := e.(type) {
+	case *OpEquals:
+		return e.lhs, "=", e.rhs, true
+	case *OpLt:
+		return e.lhs, "<", e.rhs, true
+	case *OpGt:
+		return e.lhs, ">", e.rhs, true
+	case *OpAdd:
+		return e.lhs, "+", e.rhs, true
+	case *OpSub:
+		return e.lhs, "-", e.rhs, true
+	case *OpMul:
+		return e.lhs, "*", e.rhs, true
+	case *OpDiv:
+		return e.lhs, "/", e.rhs, true
+	}
+	return nil, "", nil, false
+}
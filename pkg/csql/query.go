@@ -0,0 +1,128 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"context"
+	"io"
+	"maps"
+)
+
+// Query is a parsed and validated CSQL query. A Query is never modified after
+// Compile returns, so it is safe to Run the same Query concurrently.
+type Query struct {
+	source  string
+	steps   [][]Expression
+	options Options
+	engine  *Engine
+	// missing is the error for the first parameter that has no value, which
+	// has to be given with RunWith.
+	missing error
+}
+
+// Compile compiles a query that can only use the built-in functions.
+func Compile(query string, opts ...Option) (*Query, error) {
+	return NewEngine().Compile(query, opts...)
+}
+
+// Compile compiles a query that can use the functions registered with the
+// engine.
+func (e *Engine) Compile(query string, opts ...Option) (*Query, error) {
+	options := NewOptions()
+	for _, o := range opts {
+		o(&options)
+	}
+
+	steps, missing, err := e.build(query, options.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	return &Query{
+		source:  query,
+		steps:   steps,
+		options: options,
+		engine:  e,
+		missing: missing,
+	}, nil
+}
+
+// build parses, binds and validates a query. Parameters without a value are
+// returned as missing instead of as an error.
+func (e *Engine) build(query string, parameters map[string]string) (steps [][]Expression, missing error, err error) {
+	steps, positions, err := newParser().parseQuery(Tokenize(query))
+	if err != nil {
+		return nil, nil, err
+	}
+	missing, err = bindParameters(steps, parameters, e)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := validateQuery(steps, positions); err != nil {
+		return nil, nil, err
+	}
+	return steps, missing, nil
+}
+
+// Run runs the query with the parameter values it was compiled with. It
+// fails if a parameter has no value.
+func (q *Query) Run(ctx context.Context, source io.Reader, sink ResultSink) error {
+	if q.missing != nil {
+		return q.missing
+	}
+	return execute(ctx, q.steps, source, q.options, sink)
+}
+
+// RunWith runs the query with parameter values that are only used for this
+// run, in addition to those it was compiled with. It is safe to call
+// concurrently with different values, since the values are bound to a copy
+// of the query.
+func (q *Query) RunWith(ctx context.Context, parameters map[string]string, source io.Reader, sink ResultSink) error {
+	options := q.Options()
+	if options.Parameters == nil {
+		options.Parameters = map[string]string{}
+	}
+	for name, value := range parameters {
+		options.Parameters[name] = value
+	}
+	steps, missing, err := q.engine.build(q.source, options.Parameters)
+	if err != nil {
+		return err
+	}
+	if missing != nil {
+		return missing
+	}
+	return execute(ctx, steps, source, options, sink)
+}
+
+// Options returns the options the query was compiled with. The maps in them
+// are copies, so changing them does not change the query.
+func (q *Query) Options() Options {
+	options := q.options
+	options.JoinSources = maps.Clone(q.options.JoinSources)
+	options.Parameters = maps.Clone(q.options.Parameters)
+	return options
+}
+
+func (q *Query) String() string {
+	return q.source
+}
+
+// WriteOps writes the operations of each step of the query, in the same
+// format as Options.PrintOps.
+func (q *Query) WriteOps(w io.Writer) error {
+	return writeOps(w, q.steps)
+}
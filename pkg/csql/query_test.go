@@ -0,0 +1,632 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackbister/csql/pkg/csql"
+)
+
+func TestCompileAndRun(t *testing.T) {
+	query, err := csql.Compile("$1=a\n$0,$2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &csql.SliceSink{}
+	err = query.Run(context.Background(), strings.NewReader(testCsv), sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.Rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(sink.Rows))
+	}
+	i, ok := sink.Rows[2][0].Int()
+	if !ok || i != 4 {
+		t.Fatalf("expected int 4, got %v", sink.Rows[2][0])
+	}
+	s, ok := sink.Rows[2][1].Str()
+	if !ok || s != "a" {
+		t.Fatalf("expected string a, got %v", sink.Rows[2][1])
+	}
+	if _, ok := sink.Rows[2][1].Int(); ok {
+		t.Fatalf("expected string not to be readable as int")
+	}
+}
+
+func TestCompileInvalidQuery(t *testing.T) {
+	_, err := csql.Compile("group($0),group($1)")
+	if err == nil {
+		t.Fatalf("expected error for multiple grouping expressions")
+	}
+}
+
+func TestRunConcurrently(t *testing.T) {
+	query, err := csql.Compile("group(),sum($2)\norder(,desc)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCsv := `Peter,Part0,100
+Peter,Part1,200
+Charles,Part0,10
+Charles,Part1,20`
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sink := &csql.StringSliceSink{}
+			if err := query.Run(context.Background(), strings.NewReader(testCsv), sink); err != nil {
+				errs <- err
+				return
+			}
+			if len(sink.Rows) != 2 || sink.Rows[0][1] != "300" || sink.Rows[1][1] != "30" {
+				t.Errorf("unexpected result: %v", sink.Rows)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestRunWithParameters(t *testing.T) {
+	query, err := csql.Compile("let min = :base*2\n=:ticker,,>:min\n$1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCsv := "AAPL,1,10\nAAPL,2,50\nXOM,3,50"
+	if err := query.Run(context.Background(), strings.NewReader(testCsv), &csql.SliceSink{}); err == nil || !strings.Contains(err.Error(), "parameter :base is not defined") {
+		t.Fatalf("expected an undefined parameter error, got %v", err)
+	}
+	run := func(ticker, base string) [][]string {
+		t.Helper()
+		sink := &csql.StringSliceSink{}
+		err := query.RunWith(context.Background(), map[string]string{"ticker": ticker, "base": base}, strings.NewReader(testCsv), sink)
+		if err != nil {
+			t.Error(err)
+		}
+		return sink.Rows
+	}
+	expectColumn(t, run("AAPL", "2"), 0, "1", "2")
+	expectColumn(t, run("AAPL", "10"), 0, "2")
+	expectColumn(t, run("XOM", "2"), 0, "3")
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ticker, expected := "AAPL", "2"
+			if i%2 == 1 {
+				ticker, expected = "XOM", "3"
+			}
+			if res := run(ticker, "20"); fmt.Sprint(res) != fmt.Sprint([][]string{{expected}}) {
+				t.Errorf("unexpected result for %v: %v", ticker, res)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestOptionsAreCopied(t *testing.T) {
+	query, err := csql.Compile("=:ticker", csql.WithParameter("ticker", "AAPL"), csql.WithJoinSource("ref", "ref.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := query.Options()
+	options.Parameters["ticker"] = "XOM"
+	options.JoinSources["ref"] = "other.csv"
+	if options = query.Options(); options.Parameters["ticker"] != "AAPL" || options.JoinSources["ref"] != "ref.csv" {
+		t.Fatalf("expected the options of the query to be unchanged, got %v and %v", options.Parameters, options.JoinSources)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	query, err := csql.Compile("order($0,desc)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = query.Run(ctx, strings.NewReader(testCsv), &csql.SliceSink{})
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestMaxGroups(t *testing.T) {
+	query, err := csql.Compile("group($1)", csql.WithLimits(0, 1, 0, csql.LimitActionError))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = query.Run(context.Background(), strings.NewReader(testCsv), &csql.SliceSink{})
+	if !errors.Is(err, csql.ErrLimitExceeded) {
+		t.Fatalf("expected limit error, got %v", err)
+	}
+}
+
+func TestMaxInputRowsTruncate(t *testing.T) {
+	warnings := strings.Builder{}
+	options := csql.NewOptions()
+	options.MaxInputRows = 2
+	options.OnLimit = csql.LimitActionTruncate
+	options.Warnings = &warnings
+	query, err := csql.Compile("=", csql.WithOptions(options))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &csql.SliceSink{}
+	err = query.Run(context.Background(), strings.NewReader(testCsv), sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.Rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(sink.Rows))
+	}
+	if !strings.Contains(warnings.String(), "maximum of 2 rows") {
+		t.Fatalf("expected warning, got %q", warnings.String())
+	}
+}
+
+func TestParallelMatchesSerial(t *testing.T) {
+	input := strings.Builder{}
+	for i := 0; i < 5000; i++ {
+		input.WriteString(fmt.Sprintf("%c,%d,%d.5\n", 'A'+rune(i%7), i%13, i))
+	}
+	queries := []string{
+		">5,$2",
+		"has($0,C)\n$2,$1",
+		"group($0,$1),sum($2),sum(1)",
+		"group(),sum($2)\norder($1,desc)",
+	}
+	for _, q := range queries {
+		serial, err := csql.Compile(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parallel, err := csql.Compile(q, csql.WithParallelism(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serialSink := &csql.StringSliceSink{}
+		if err := serial.Run(context.Background(), strings.NewReader(input.String()), serialSink); err != nil {
+			t.Fatal(err)
+		}
+		parallelSink := &csql.StringSliceSink{}
+		if err := parallel.Run(context.Background(), strings.NewReader(input.String()), parallelSink); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(serialSink.Rows) != fmt.Sprint(parallelSink.Rows) {
+			t.Fatalf("parallel result differs from serial result for query %q", q)
+		}
+	}
+}
+
+func runJoin(t *testing.T, query string) [][]string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sectors.csv")
+	if err := os.WriteFile(path, []byte("AAPL,Tech\nXOM,Energy\nMSFT,Tech\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	q, err := csql.Compile(query, csql.WithJoinSource("sectors", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &csql.StringSliceSink{}
+	err = q.Run(context.Background(), strings.NewReader("AAPL,100\nIBM,7\nXOM,5\n"), sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink.Rows
+}
+
+func TestJoin(t *testing.T) {
+	res := runJoin(t, "join(sectors,$0,$0)")
+	expected := [][]string{{"AAPL", "100", "AAPL", "Tech"}, {"XOM", "5", "XOM", "Energy"}}
+	if fmt.Sprint(res) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	res = runJoin(t, "join(sectors,$0,$0,left)\n$0,$3")
+	expected = [][]string{{"AAPL", "Tech"}, {"IBM", ""}, {"XOM", "Energy"}}
+	if fmt.Sprint(res) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	res = runJoin(t, "join(sectors,$0,$0,anti)")
+	expected = [][]string{{"IBM", "7"}}
+	if fmt.Sprint(res) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	res = runJoin(t, "join(sectors,$0,$0)\ngroup($3),sum($1)")
+	expected = [][]string{{"Tech", "100"}, {"Energy", "5"}}
+	if fmt.Sprint(res) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestJoinMissingFile(t *testing.T) {
+	q, err := csql.Compile("join(missing.csv,$0,$0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.Run(context.Background(), strings.NewReader("a\n"), &csql.SliceSink{})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a file not found error, got %v", err)
+	}
+}
+
+func TestJoinWithoutPaths(t *testing.T) {
+	q, err := csql.Compile("join(missing.csv,$0,$0)", csql.WithoutJoinPaths())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.Run(context.Background(), strings.NewReader("a\n"), &csql.SliceSink{})
+	if err == nil || !strings.Contains(err.Error(), "not a registered join source") {
+		t.Fatalf("expected an unregistered path to be rejected, got %v", err)
+	}
+}
+
+func TestJoinSkipsHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sectors.csv")
+	if err := os.WriteFile(path, []byte("ticker,sector\nAAPL,Tech\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	q, err := csql.Compile("join(sectors,$0,$0)", csql.WithJoinSource("sectors", path), csql.WithSkip(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &csql.StringSliceSink{}
+	err = q.Run(context.Background(), strings.NewReader("ticker,price\nAAPL,100\n"), sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"AAPL", "100", "AAPL", "Tech"}}
+	if fmt.Sprint(sink.Rows) != fmt.Sprint(expected) {
+		t.Fatalf("expected the header of both files to be skipped, got %v", sink.Rows)
+	}
+}
+
+func TestTokenPositions(t *testing.T) {
+	tokens := csql.Tokenize("=ab,$1\nsum(ö,$2)")
+	expected := []string{"1:1", "1:2", "1:4", "1:5", "1:6", "1:7", "2:1", "2:4", "2:5", "2:6", "2:7", "2:8", "2:9"}
+	actual := []string{}
+	for _, tok := range tokens {
+		actual = append(actual, fmt.Sprintf("%d:%d", tok.Line, tok.Col))
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestCompileErrorPosition(t *testing.T) {
+	query := "=a\n$0,\tsum($1,$2))"
+	_, err := csql.Compile(query)
+	var d *csql.Diagnostic
+	if !errors.As(err, &d) {
+		t.Fatalf("expected a diagnostic, got %v", err)
+	}
+	if d.Line != 2 || d.Col != 15 {
+		t.Fatalf("expected error at line 2, column 15, got %v", d)
+	}
+	expected := "line 2, column 15: expected ',' but got ')'\n  $0,\tsum($1,$2))\n     \t          ^"
+	if d.Highlight(query) != expected {
+		t.Fatalf("expected %q, got %q", expected, d.Highlight(query))
+	}
+
+	_, err = csql.Compile("=a\norder($0),rownum()")
+	if !errors.As(err, &d) || d.Line != 2 || d.Col != 1 {
+		t.Fatalf("expected an error at the start of step 2, got %v", err)
+	}
+}
+
+func TestBindErrors(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"hass($0,x)", "line 1, column 1: function 'hass' not found, did you mean has?"},
+		{"=a\n$0,summ($1)", "line 2, column 4: function 'summ' not found, did you mean sum?"},
+		{"frobnicate($0)", "line 1, column 1: function 'frobnicate' not found"},
+		{"group($0),sum($0,$1)", "line 1, column 11: sum requires exactly 1 argument, got: 2"},
+		{"int($0,$1)", "line 1, column 1: int requires exactly 1 argument, got: 2"},
+		{"case(a)", "line 1, column 1: case requires at least 2 arguments, got: 1"},
+		{"date($0,a,b)", "line 1, column 1: date requires at most 2 arguments, got: 3"},
+		{"if(date($0),a,b)", "line 1, column 1: argument 1 of if must be bool, got date"},
+	}
+	for _, test := range tests {
+		_, err := csql.Compile(test.query)
+		var d *csql.Diagnostic
+		if !errors.As(err, &d) {
+			t.Fatalf("expected a diagnostic for %q, got %v", test.query, err)
+		}
+		if err.Error() != test.expected {
+			t.Fatalf("expected %q for %q, got %q", test.expected, test.query, err.Error())
+		}
+	}
+}
+
+func TestEngineFunctions(t *testing.T) {
+	engine := csql.NewEngine()
+	err := engine.RegisterFunction("bps", []csql.ValueType{csql.ValueTypeDouble}, csql.ValueTypeDouble, func(args []csql.Value) (csql.Value, error) {
+		f, _ := args[0].Float()
+		return csql.FloatValue(f * 10000), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rates := map[string]float64{"USD": 1, "EUR": 1.5}
+	err = engine.RegisterFunction("fx", []csql.ValueType{csql.ValueTypeDouble, csql.ValueTypeString}, csql.ValueTypeDouble, func(args []csql.Value) (csql.Value, error) {
+		amount, _ := args[0].Float()
+		ccy, _ := args[1].Str()
+		rate, ok := rates[ccy]
+		if !ok {
+			return csql.Value{}, fmt.Errorf("unknown currency %v", ccy)
+		}
+		return csql.FloatValue(amount * rate), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = engine.RegisterAggregate("maximum", csql.ValueTypeDouble, func(a, b csql.Value) (csql.Value, error) {
+		x, _ := a.Float()
+		y, _ := b.Float()
+		return csql.FloatValue(max(x, y)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := engine.Compile("$0,bps(),fx($2,$3)\ngroup($0),maximum($2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &csql.StringSliceSink{}
+	input := "A,0.0001,10,USD\nA,0.0002,20,EUR\nB,0.5,4,EUR"
+	if err := query.Run(context.Background(), strings.NewReader(input), sink); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"A", "30"}, {"B", "6"}}
+	if fmt.Sprint(sink.Rows) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, sink.Rows)
+	}
+
+	if _, err := csql.Compile("bps($0)"); err == nil {
+		t.Fatalf("expected functions registered with an engine not to be available to other queries")
+	}
+	if _, err := engine.Compile("bps($0,$1)"); err == nil || !strings.Contains(err.Error(), "bps requires exactly 1 argument") {
+		t.Fatalf("expected an arity error, got %v", err)
+	}
+	if err := engine.RegisterFunction("has", nil, csql.ValueTypeBool, nil); err == nil {
+		t.Fatalf("expected an error when registering a built-in function")
+	}
+	if err := engine.RegisterFunction("nothing", nil, csql.ValueTypeBool, nil); err == nil {
+		t.Fatalf("expected an error when registering a nil function")
+	}
+	if err := engine.RegisterAggregate("nothing", csql.ValueTypeDouble, nil); err == nil {
+		t.Fatalf("expected an error when registering a nil aggregation")
+	}
+}
+
+func TestWriteOps(t *testing.T) {
+	query, err := csql.Compile("=ABC,$1\nsum($1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb := &strings.Builder{}
+	if err := query.WriteOps(sb); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"step 1:", "0 filter", "1 projection", "step 2:", "0 aggregation"}
+	lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %q", len(expected), sb.String())
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(strings.TrimSpace(lines[i]), e) {
+			t.Fatalf("expected line %d to start with %q, got %q", i, e, lines[i])
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	query, err := csql.Compile("=AAPL,,>1.5\ngroup($0),sum($2)\norder($1,desc)\nlimit(5)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := query.Explain(strings.NewReader("AAPL,1,2.5\nMSFT,2,3.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(plan.Input) != "[string int double]" {
+		t.Fatalf("expected the input types to be inferred, got %v", plan.Input)
+	}
+	expected := []struct {
+		kind       string
+		streaming  bool
+		operations string
+	}{
+		{"projection", true, "[filter $0=AAPL bool [$0]] [filter $2>1.5 bool [$2]]"},
+		{"group", false, "[group key $0 string []] [aggregate sum($2) double []]"},
+		{"order", false, "[sort key $1 desc unknown []]"},
+		{"limit", true, "[limit 5  []]"},
+	}
+	if len(plan.Steps) != len(expected) {
+		t.Fatalf("expected %d steps, got %d", len(expected), len(plan.Steps))
+	}
+	for i, e := range expected {
+		step := plan.Steps[i]
+		operations := []string{}
+		for _, op := range step.Operations {
+			operations = append(operations, fmt.Sprintf("[%v %v %v %v]", op.Role, op.Expr, op.Type, op.Implicit))
+		}
+		if step.Kind != e.kind || step.Streaming != e.streaming || strings.Join(operations, " ") != e.operations {
+			t.Fatalf("step %d: expected %v %v %v, got %v %v %v", i+1, e.kind, e.streaming, e.operations, step.Kind, step.Streaming, strings.Join(operations, " "))
+		}
+	}
+	if plan.Steps[2].Buffers != "the first 5 rows" {
+		t.Fatalf("expected order followed by limit to only hold the first rows, got %q", plan.Steps[2].Buffers)
+	}
+
+	plan, err = query.Explain(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Input != nil || plan.Steps[0].Operations[0].Type != "" {
+		t.Fatalf("expected no types without input, got %v and %q", plan.Input, plan.Steps[0].Operations[0].Type)
+	}
+
+	query, err = csql.Compile("order($0),tail(2)\nlimit(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err = query.Explain(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Steps[0].Buffers != "all rows" {
+		t.Fatalf("expected order with tail to hold all rows, got %q", plan.Steps[0].Buffers)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+		explicit string
+	}{
+		{"=ABC,,>5", "=ABC,,>5\n", "$0=ABC,,$2>5\n"},
+		{"where(=ABC),has(x)", "?=ABC,has(x)\n", "?$0=ABC,has($1,x)\n"},
+		{"group(),sum()\norder($1,desc)\nlimit(10,0)", "group(),sum()\norder($1,desc)\nlimit(10)\n", "group($0),sum($1)\norder($1,desc)\nlimit(10)\n"},
+		{"!=x,if($1<5,a,b),$*!$2", "!=x,if($1<5,a,b),$*!$2\n", "!=x,if($1<5,a,b),$*!$2\n"},
+		{"cumsum(,over($0)),lag($1,1),rank(,desc,nulls last)", "cumsum(,over($0)),lag($1),rank(,desc,nulls last)\n", "cumsum($0,over($0)),lag($1),rank($2,desc,nulls last)\n"},
+		{"join(ref,,$1,left)\npivot($0,$1,sum($2))", "join(ref,,$1,left)\npivot($0,$1,sum($2))\n", "join(ref,$0,$1,left)\npivot($0,$1,sum($2))\n"},
+		{"let t = ABC\n=:t", "let t = ABC\n=:t\n", "let t = ABC\n$0=:t\n"},
+		{
+			"# Large trades\ndef big = >100   # over 100\n\n\n=ABC,\\\n  ,big\n",
+			"# Large trades\ndef big = >100 # over 100\n\n=ABC,,big\n",
+			"# Large trades\ndef big = >100 # over 100\n\n$0=ABC,,big\n",
+		},
+		{
+			"=ABC,\\\n  >5   # large\n\n$1\n",
+			"=ABC,>5 # large\n\n$1\n",
+			"$0=ABC,$1>5 # large\n\n$1\n",
+		},
+	}
+	for _, test := range tests {
+		for _, explicit := range []bool{false, true} {
+			expected := test.expected
+			if explicit {
+				expected = test.explicit
+			}
+			formatted, err := csql.Format(test.query, explicit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if formatted != expected {
+				t.Fatalf("expected %q to be formatted as %q, got %q", test.query, expected, formatted)
+			}
+			again, err := csql.Format(formatted, explicit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again != formatted {
+				t.Fatalf("expected formatting %q again to give the same query, got %q", formatted, again)
+			}
+		}
+	}
+
+	// The formatted query must run the same way as the original.
+	input := "ABC,1,200\nDEF,2,300\nABC,3,50"
+	for _, query := range []string{"def big = >100\n=ABC,,big", "where(=ABC),keep(=1)", "!=ABC,$1", ",!>100"} {
+		formatted, err := csql.Format(query, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := runQuery(t, query, input)
+		if res := runQuery(t, formatted, input); fmt.Sprint(res) != fmt.Sprint(expected) {
+			t.Fatalf("expected %q to give %v like %q, got %v", formatted, expected, query, res)
+		}
+	}
+}
+
+func TestToSQL(t *testing.T) {
+	query, err := csql.Compile("=AAPL,$1*$2,$0\ngroup($1),sum($0)\norder($1,desc)\nlimit(5)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql, err := query.ToSQL("input", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `WITH step1 AS (
+  SELECT c1 * c2 AS c0, c0 AS c1
+  FROM input
+  WHERE c0 = 'AAPL'
+), step2 AS (
+  SELECT c1 AS c0, SUM(c0) AS c1
+  FROM step1
+  GROUP BY c1
+)
+SELECT *
+FROM step2
+ORDER BY c1 DESC
+LIMIT 5;
+`
+	if sql != expected {
+		t.Fatalf("expected %v, got %v", expected, sql)
+	}
+
+	sql, err = query.ToSQL("input", []string{"sym", "price", "order"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(sql, `SELECT price * "order" AS c0, sym`) || !strings.Contains(sql, "GROUP BY sym") {
+		t.Fatalf("expected the columns to be named by the header, got %v", sql)
+	}
+
+	// A group after ordering does not need the order to be kept.
+	query, err = csql.Compile("order($1,desc)\nlimit(5)\ngroup($0),sum($1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query.ToSQL("input", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{"tail(5)", "sample(5,1)", "cumsum($1)", "order($0,natural)", "distinct($0)", "pivot($0,$1,sum($2))", "order($1)\n$0", "order($1,desc)\ndistinct()", "order($1)\nlimit(5)\n$0", "order($0),sample(3)"} {
+		query, err := csql.Compile(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := query.ToSQL("input", nil); err == nil {
+			t.Fatalf("expected %q to not be translatable to SQL", q)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type Column struct {
+	Name string
+	Type ValueType
+}
+
+// ResultSink receives the result of a query. Begin is called once with the
+// schema of the result, followed by one WriteRow call per row and finally End.
+// Rows may be shorter than the schema if the input had ragged rows.
+type ResultSink interface {
+	Begin(schema []Column) error
+	WriteRow(row []Value) error
+	End() error
+}
+
+type CSVSink struct {
+	writer *csv.Writer
+	header bool
+}
+
+func NewCSVSink(w io.Writer, separator string, header bool) *CSVSink {
+	writer := csv.NewWriter(w)
+	if sep, _ := utf8.DecodeRuneInString(separator); sep != utf8.RuneError {
+		writer.Comma = sep
+	}
+	return &CSVSink{
+		writer: writer,
+		header: header,
+	}
+}
+
+func (s *CSVSink) Begin(schema []Column) error {
+	if !s.header {
+		return nil
+	}
+	names := make([]string, len(schema))
+	for i, c := range schema {
+		names[i] = c.Name
+	}
+	return s.writer.Write(names)
+}
+
+func (s *CSVSink) WriteRow(row []Value) error {
+	record := make([]string, len(row))
+	for i := range row {
+		record[i] = row[i].String()
+	}
+	return s.writer.Write(record)
+}
+
+func (s *CSVSink) End() error {
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+// JSONSink writes the result as a JSON array with one object per row, keyed by
+// column name.
+type JSONSink struct {
+	w      io.Writer
+	schema []Column
+	rows   int
+}
+
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{
+		w: w,
+	}
+}
+
+func (s *JSONSink) Begin(schema []Column) error {
+	s.schema = schema
+	s.rows = 0
+	_, err := io.WriteString(s.w, "[")
+	return err
+}
+
+func (s *JSONSink) WriteRow(row []Value) error {
+	b := strings.Builder{}
+	if s.rows > 0 {
+		b.WriteRune(',')
+	}
+	b.WriteString("\n  {")
+	for i := range row {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		name := fmt.Sprintf("$%d", i)
+		if i < len(s.schema) {
+			name = s.schema[i].Name
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return err
+		}
+		b.Write(key)
+		b.WriteString(": ")
+		val, err := jsonValue(&row[i])
+		if err != nil {
+			return err
+		}
+		b.Write(val)
+	}
+	b.WriteRune('}')
+	s.rows++
+	_, err := io.WriteString(s.w, b.String())
+	return err
+}
+
+func (s *JSONSink) End() error {
+	end := "]\n"
+	if s.rows > 0 {
+		end = "\n]\n"
+	}
+	_, err := io.WriteString(s.w, end)
+	return err
+}
+
+func jsonValue(v *Value) ([]byte, error) {
+	switch v.typ {
+	case ValueTypeBool, ValueTypeInt, ValueTypeString:
+		return json.Marshal(v.value)
+	case ValueTypeDouble:
+		f := v.value.(float64)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return json.Marshal(v.String())
+		}
+		return json.Marshal(f)
+	case ValueTypeDate:
+		return json.Marshal(v.value.(time.Time).Format(time.RFC3339Nano))
+	case ValueTypeUnknown:
+		return []byte("null"), nil
+	}
+	return json.Marshal(v.String())
+}
+
+// TableSink writes the result as an aligned plain text table. Since the column
+// widths depend on every row, the rows are buffered until End is called.
+type TableSink struct {
+	w      io.Writer
+	schema []Column
+	rows   [][]string
+}
+
+func NewTableSink(w io.Writer) *TableSink {
+	return &TableSink{
+		w: w,
+	}
+}
+
+func (s *TableSink) Begin(schema []Column) error {
+	s.schema = schema
+	s.rows = nil
+	return nil
+}
+
+func (s *TableSink) WriteRow(row []Value) error {
+	record := make([]string, len(row))
+	for i := range row {
+		record[i] = row[i].String()
+	}
+	s.rows = append(s.rows, record)
+	return nil
+}
+
+func (s *TableSink) End() error {
+	// The schema is inferred from the first rows, so later rows may have more
+	// columns than it.
+	for _, r := range s.rows {
+		for j := len(s.schema); j < len(r); j++ {
+			s.schema = append(s.schema, Column{
+				Name: "$" + strconv.Itoa(j),
+				Type: ValueTypeUnknown,
+			})
+		}
+	}
+	widths := make([]int, len(s.schema))
+	for i, c := range s.schema {
+		widths[i] = utf8.RuneCountInString(c.Name)
+	}
+	for _, r := range s.rows {
+		for i, v := range r {
+			widths[i] = max(widths[i], utf8.RuneCountInString(v))
+		}
+	}
+
+	b := strings.Builder{}
+	names := make([]string, len(s.schema))
+	separators := make([]string, len(s.schema))
+	for i, c := range s.schema {
+		names[i] = c.Name
+		separators[i] = strings.Repeat("-", widths[i])
+	}
+	s.writeLine(&b, names, widths)
+	s.writeLine(&b, separators, widths)
+	for _, r := range s.rows {
+		s.writeLine(&b, r, widths)
+	}
+	_, err := io.WriteString(s.w, b.String())
+	return err
+}
+
+func (s *TableSink) writeLine(b *strings.Builder, cells []string, widths []int) {
+	for i, cell := range cells {
+		if i > 0 {
+			b.WriteString(" | ")
+		}
+		padding := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+		if s.schema[i].Type == ValueTypeInt || s.schema[i].Type == ValueTypeDouble {
+			b.WriteString(padding)
+			b.WriteString(cell)
+		} else {
+			b.WriteString(cell)
+			if i != len(cells)-1 {
+				b.WriteString(padding)
+			}
+		}
+	}
+	b.WriteRune('\n')
+}
+
+// SliceSink collects the typed result in memory.
+type SliceSink struct {
+	Schema []Column
+	Rows   [][]Value
+}
+
+func (s *SliceSink) Begin(schema []Column) error {
+	s.Schema = schema
+	s.Rows = nil
+	return nil
+}
+
+func (s *SliceSink) WriteRow(row []Value) error {
+	s.Rows = append(s.Rows, row)
+	return nil
+}
+
+func (s *SliceSink) End() error {
+	return nil
+}
+
+// StringSliceSink collects the result in memory as strings, in the same format
+// as the CSV output.
+type StringSliceSink struct {
+	Schema []Column
+	Rows   [][]string
+}
+
+func (s *StringSliceSink) Begin(schema []Column) error {
+	s.Schema = schema
+	s.Rows = [][]string{}
+	return nil
+}
+
+func (s *StringSliceSink) WriteRow(row []Value) error {
+	record := make([]string, len(row))
+	for i := range row {
+		record[i] = row[i].String()
+	}
+	s.Rows = append(s.Rows, record)
+	return nil
+}
+
+func (s *StringSliceSink) End() error {
+	return nil
+}
+
+func inferSchema(resultSet [][]Value) []Column {
+	schema := []Column{}
+	for _, r := range resultSet {
+		for j, v := range r {
+			if j >= len(schema) {
+				schema = append(schema, Column{
+					Name: "$" + strconv.Itoa(j),
+					Type: v.typ,
+				})
+			} else if schema[j].Type != v.typ {
+				schema[j].Type = ValueTypeUnknown
+			}
+		}
+	}
+	return schema
+}
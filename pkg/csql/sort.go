@@ -0,0 +1,584 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"bufio"
+	"cmp"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type sortRow struct {
+	keys []Value
+	row  []Value
+	seq  int
+}
+
+// rowComparator compares rows by the ordering expressions of a step. Rows
+// with equal keys are ordered by seq, which keeps the sort stable. Since the
+// sort functions do not allow returning errors, a cancelled context is stored
+// in err and all later comparisons return 0.
+type rowComparator struct {
+	ctx             context.Context
+	orderOperations []*OrderingExpr
+	comparisons     int
+	err             error
+}
+
+func (c *rowComparator) newSortRow(row []Value, seq int) (*sortRow, error) {
+	keys := make([]Value, len(c.orderOperations))
+	for i, op := range c.orderOperations {
+		// Rows that are too short to have the column being ordered by are
+		// treated as having a null value in it.
+		if ref, ok := op.argument.(*ColumnReferenceExpression); ok {
+			if _, ok := ref.resolve(len(row)); !ok {
+				continue
+			}
+		}
+		res, err := op.argument.Execute(i, row)
+		if err != nil {
+			return nil, err
+		}
+		if res != nil && res.value != nil {
+			keys[i] = *res.value
+		}
+	}
+	return &sortRow{
+		keys: keys,
+		row:  row,
+		seq:  seq,
+	}, nil
+}
+
+func (c *rowComparator) compare(a, b *sortRow) int {
+	if c.err != nil {
+		return 0
+	}
+	c.comparisons++
+	if c.comparisons%contextCheckInterval == 0 {
+		if err := c.ctx.Err(); err != nil {
+			c.err = err
+			return 0
+		}
+	}
+	res := compareKeys(c.orderOperations, a.keys, b.keys)
+	if res == 0 {
+		return cmp.Compare(a.seq, b.seq)
+	}
+	return res
+}
+
+func compareKeys(orderOperations []*OrderingExpr, iv, jv []Value) int {
+	for i, op := range orderOperations {
+		iNull, jNull := iv[i].IsNull(), jv[i].IsNull()
+		if iNull || jNull {
+			if iNull && jNull {
+				continue
+			}
+			if iNull == op.nullsFirst() {
+				return -1
+			}
+			return 1
+		}
+		res := compareValues(&iv[i], &jv[i], op.collation)
+		if res == 0 {
+			continue
+		}
+		if op.direction == OrderDirectionDesc {
+			return -res
+		}
+		return res
+	}
+	return 0
+}
+
+// typeRank decides how values of different types are ordered relative to each
+// other. Ints and doubles share a rank since they are compared numerically.
+func typeRank(typ ValueType) int {
+	switch typ {
+	case ValueTypeBool:
+		return 0
+	case ValueTypeInt, ValueTypeDouble:
+		return 1
+	case ValueTypeDate:
+		return 2
+	case ValueTypeString:
+		return 3
+	}
+	return 4
+}
+
+func compareValues(a, b *Value, collation Collation) int {
+	rankA, rankB := typeRank(a.typ), typeRank(b.typ)
+	if rankA != rankB {
+		return cmp.Compare(rankA, rankB)
+	}
+	switch a.typ {
+	case ValueTypeBool:
+		ab, bb := a.value.(bool), b.value.(bool)
+		if ab == bb {
+			return 0
+		} else if !ab {
+			return -1
+		}
+		return 1
+	case ValueTypeInt:
+		if b.typ == ValueTypeInt {
+			return cmp.Compare(a.value.(int64), b.value.(int64))
+		}
+		return cmp.Compare(float64(a.value.(int64)), b.value.(float64))
+	case ValueTypeDouble:
+		if b.typ == ValueTypeInt {
+			return cmp.Compare(a.value.(float64), float64(b.value.(int64)))
+		}
+		return cmp.Compare(a.value.(float64), b.value.(float64))
+	case ValueTypeDate:
+		return a.value.(time.Time).Compare(b.value.(time.Time))
+	case ValueTypeString:
+		return compareStrings(a.value.(string), b.value.(string), collation)
+	}
+	return strings.Compare(a.String(), b.String())
+}
+
+func compareStrings(a, b string, collation Collation) int {
+	switch collation {
+	case CollationNoCase:
+		return compareNoCase(a, b)
+	case CollationNatural:
+		return compareNatural(a, b)
+	}
+	return strings.Compare(a, b)
+}
+
+func compareNoCase(a, b string) int {
+	for a != "" && b != "" {
+		ra, sizeA := utf8.DecodeRuneInString(a)
+		rb, sizeB := utf8.DecodeRuneInString(b)
+		if res := cmp.Compare(unicode.ToLower(ra), unicode.ToLower(rb)); res != 0 {
+			return res
+		}
+		a, b = a[sizeA:], b[sizeB:]
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+func compareNatural(a, b string) int {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			digitsA, digitsB := digitPrefix(a), digitPrefix(b)
+			a, b = a[len(digitsA):], b[len(digitsB):]
+			trimmedA := strings.TrimLeft(digitsA, "0")
+			trimmedB := strings.TrimLeft(digitsB, "0")
+			if res := cmp.Compare(len(trimmedA), len(trimmedB)); res != 0 {
+				return res
+			}
+			if res := strings.Compare(trimmedA, trimmedB); res != 0 {
+				return res
+			}
+			continue
+		}
+		ra, sizeA := utf8.DecodeRuneInString(a)
+		rb, sizeB := utf8.DecodeRuneInString(b)
+		if res := cmp.Compare(ra, rb); res != 0 {
+			return res
+		}
+		a, b = a[sizeA:], b[sizeB:]
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func digitPrefix(s string) string {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i]
+}
+
+// externalSorter sorts rows in memory until more than memoryRows rows have
+// been added. After that, each batch of memoryRows rows is sorted and written
+// to a temporary file, and the files are merged when the rows are read back.
+type externalSorter struct {
+	cmp        *rowComparator
+	memoryRows int
+	tempDir    string
+	buffer     []*sortRow
+	runs       []*os.File
+	added      int
+}
+
+func (s *externalSorter) add(row []Value) error {
+	sr, err := s.cmp.newSortRow(row, s.added)
+	if err != nil {
+		return err
+	}
+	s.added++
+	s.buffer = append(s.buffer, sr)
+	if s.memoryRows > 0 && len(s.buffer) >= s.memoryRows {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *externalSorter) sortBuffer() error {
+	slices.SortStableFunc(s.buffer, s.cmp.compare)
+	return s.cmp.err
+}
+
+func (s *externalSorter) spill() error {
+	if err := s.sortBuffer(); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.tempDir, "csql-sort-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for sorting: %w", err)
+	}
+	s.runs = append(s.runs, f)
+	w := bufio.NewWriter(f)
+	for _, sr := range s.buffer {
+		if err := writeRow(w, sr.row); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.buffer = s.buffer[:0]
+	return nil
+}
+
+func (s *externalSorter) iterator() (rowIterator, error) {
+	if len(s.runs) == 0 {
+		if err := s.sortBuffer(); err != nil {
+			return nil, err
+		}
+		rows := make([][]Value, len(s.buffer))
+		for i, sr := range s.buffer {
+			rows[i] = sr.row
+		}
+		return &sliceIterator{rows: rows}, nil
+	}
+	if len(s.buffer) > 0 {
+		if err := s.spill(); err != nil {
+			return nil, err
+		}
+	}
+	m := &mergeIterator{
+		cmp: s.cmp,
+	}
+	for i, f := range s.runs {
+		r := &runReader{
+			reader: bufio.NewReader(f),
+			run:    i,
+		}
+		ok, err := r.advance(s.cmp)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			m.readers = append(m.readers, r)
+		}
+	}
+	heap.Init(m)
+	return m, nil
+}
+
+func (s *externalSorter) close() {
+	for _, f := range s.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.runs = nil
+}
+
+type runReader struct {
+	reader  *bufio.Reader
+	run     int
+	current *sortRow
+}
+
+func (r *runReader) advance(cmp *rowComparator) (bool, error) {
+	row, err := readRow(r.reader)
+	if err == io.EOF {
+		r.current = nil
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	r.current, err = cmp.newSortRow(row, r.run)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// mergeIterator merges sorted runs using a heap ordered by each run's current
+// row. The rows read back from a run use the run as their seq, so that ties
+// are broken in input order.
+type mergeIterator struct {
+	cmp     *rowComparator
+	readers []*runReader
+}
+
+func (m *mergeIterator) Len() int {
+	return len(m.readers)
+}
+
+func (m *mergeIterator) Less(i, j int) bool {
+	return m.cmp.compare(m.readers[i].current, m.readers[j].current) < 0
+}
+
+func (m *mergeIterator) Swap(i, j int) {
+	m.readers[i], m.readers[j] = m.readers[j], m.readers[i]
+}
+
+func (m *mergeIterator) Push(x any) {
+	m.readers = append(m.readers, x.(*runReader))
+}
+
+func (m *mergeIterator) Pop() any {
+	last := m.readers[len(m.readers)-1]
+	m.readers = m.readers[:len(m.readers)-1]
+	return last
+}
+
+func (m *mergeIterator) Next() ([]Value, error) {
+	if m.cmp.err != nil {
+		return nil, m.cmp.err
+	}
+	if len(m.readers) == 0 {
+		return nil, io.EOF
+	}
+	r := m.readers[0]
+	row := r.current.row
+	ok, err := r.advance(m.cmp)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		heap.Fix(m, 0)
+	} else {
+		heap.Pop(m)
+	}
+	return row, nil
+}
+
+// topNSorter keeps the n smallest rows in a heap with the largest of them on
+// top, so a limited sort only needs memory for n rows.
+type topNSorter struct {
+	cmp   *rowComparator
+	n     int
+	rows  []*sortRow
+	added int
+}
+
+func newTopNSorter(cmp *rowComparator, n int) *topNSorter {
+	return &topNSorter{
+		cmp: cmp,
+		n:   n,
+	}
+}
+
+func (t *topNSorter) less(a, b *sortRow) bool {
+	return t.cmp.compare(a, b) < 0
+}
+
+func (t *topNSorter) Len() int {
+	return len(t.rows)
+}
+
+func (t *topNSorter) Less(i, j int) bool {
+	return t.less(t.rows[j], t.rows[i])
+}
+
+func (t *topNSorter) Swap(i, j int) {
+	t.rows[i], t.rows[j] = t.rows[j], t.rows[i]
+}
+
+func (t *topNSorter) Push(x any) {
+	t.rows = append(t.rows, x.(*sortRow))
+}
+
+func (t *topNSorter) Pop() any {
+	last := t.rows[len(t.rows)-1]
+	t.rows = t.rows[:len(t.rows)-1]
+	return last
+}
+
+func (t *topNSorter) add(row []Value) error {
+	if t.n == 0 {
+		return nil
+	}
+	sr, err := t.cmp.newSortRow(row, t.added)
+	if err != nil {
+		return err
+	}
+	t.added++
+	if len(t.rows) < t.n {
+		heap.Push(t, sr)
+	} else if t.less(sr, t.rows[0]) {
+		t.rows[0] = sr
+		heap.Fix(t, 0)
+	}
+	return t.cmp.err
+}
+
+func (t *topNSorter) iterator() (rowIterator, error) {
+	slices.SortFunc(t.rows, t.cmp.compare)
+	if t.cmp.err != nil {
+		return nil, t.cmp.err
+	}
+	rows := make([][]Value, len(t.rows))
+	for i, sr := range t.rows {
+		rows[i] = sr.row
+	}
+	return &sliceIterator{rows: rows}, nil
+}
+
+// writeRow and readRow encode rows in the temporary files used for sorting.
+// Each value is written as its type followed by its payload, so that rows read
+// back have the same types as when they were written.
+func writeRow(w *bufio.Writer, row []Value) error {
+	buf := binary.AppendUvarint(nil, uint64(len(row)))
+	for _, v := range row {
+		if v.IsNull() {
+			buf = append(buf, byte(ValueTypeUnknown))
+			continue
+		}
+		buf = append(buf, byte(v.typ))
+		switch v.typ {
+		case ValueTypeString:
+			str := v.value.(string)
+			buf = binary.AppendUvarint(buf, uint64(len(str)))
+			buf = append(buf, str...)
+		case ValueTypeBool:
+			if v.value.(bool) {
+				buf = append(buf, 1)
+			} else {
+				buf = append(buf, 0)
+			}
+		case ValueTypeInt:
+			buf = binary.AppendVarint(buf, v.value.(int64))
+		case ValueTypeDouble:
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.value.(float64)))
+		case ValueTypeDate:
+			b, err := v.value.(time.Time).MarshalBinary()
+			if err != nil {
+				return err
+			}
+			buf = binary.AppendUvarint(buf, uint64(len(b)))
+			buf = append(buf, b...)
+		default:
+			return fmt.Errorf("cannot write value of type %v to temporary file", v.typ)
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func readRow(r *bufio.Reader) ([]Value, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	row := make([]Value, n)
+	for i := range row {
+		typ, err := r.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		row[i].typ = ValueType(typ)
+		switch row[i].typ {
+		case ValueTypeUnknown:
+		case ValueTypeString:
+			b, err := readBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			row[i].value = string(b)
+		case ValueTypeBool:
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			row[i].value = b != 0
+		case ValueTypeInt:
+			v, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			row[i].value = v
+		case ValueTypeDouble:
+			b := make([]byte, 8)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			row[i].value = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		case ValueTypeDate:
+			b, err := readBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			t := time.Time{}
+			if err := t.UnmarshalBinary(b); err != nil {
+				return nil, err
+			}
+			row[i].value = t
+		default:
+			return nil, fmt.Errorf("unexpected value type %v in temporary file", row[i].typ)
+		}
+	}
+	return row, nil
+}
+
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -30,72 +30,113 @@ const (
 	TokenTypeRParen
 )
 
+// Token is a token in a query. Line and Col are the position of its first
+// character, both counted from 1. Col counts characters, not bytes.
 type Token struct {
-	Typ TokenType
-	Str string
+	Typ  TokenType
+	Str  string
+	Line int
+	Col  int
 }
 
 var operators = "$!=><+-*/"
 
+// Tokenize splits a query into tokens. A # at the start of a line or after
+// whitespace starts a comment that runs to the end of the line. Lines that are
+// blank or only hold a comment are skipped, and a \ at the end of a line joins
+// it with the next line, ignoring the indentation of the next line. Lines may
+// end with \r\n, as in files saved on Windows.
 func Tokenize(query string) []Token {
+	query = strings.ReplaceAll(query, "\r\n", "\n")
 	res := []Token{}
 
 	str := strings.Builder{}
-	for _, c := range query {
-		if c == ',' {
-			if str.Len() > 0 {
-				res = append(res, Token{
-					Typ: TokenTypeString,
-					Str: str.String(),
-				})
-				str.Reset()
+	line, col := 1, 0
+	strLine, strCol := 0, 0
+	// lineStart is the index in res of the first token on the current line.
+	lineStart := 0
+	flush := func() {
+		if str.Len() > 0 {
+			res = append(res, Token{
+				Typ:  TokenTypeString,
+				Str:  str.String(),
+				Line: strLine,
+				Col:  strCol,
+			})
+			str.Reset()
+		}
+	}
+	runes := []rune(query)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		col++
+		if c == '#' && (i == 0 || runes[i-1] == '\n' || isSpace(runes[i-1])) {
+			// Whitespace before a comment is not part of the query.
+			trimmed := strings.TrimRight(str.String(), " \t")
+			str.Reset()
+			str.WriteString(trimmed)
+			for i+1 < len(runes) && runes[i+1] != '\n' {
+				i++
 			}
-			res = append(res, Token{Typ: TokenTypeComma, Str: ""})
-		} else if strings.ContainsRune(operators, c) {
-			if str.Len() > 0 {
-				res = append(res, Token{
-					Typ: TokenTypeString,
-					Str: str.String(),
-				})
-				str.Reset()
+			continue
+		}
+		if c == '\\' && i+1 < len(runes) && runes[i+1] == '\n' {
+			i++
+			line++
+			col = 0
+			for i+1 < len(runes) && isSpace(runes[i+1]) {
+				i++
+				col++
 			}
-			res = append(res, Token{Typ: TokenTypeOperator, Str: string(c)})
+			continue
+		}
+		if c == ',' {
+			flush()
+			res = append(res, Token{Typ: TokenTypeComma, Str: "", Line: line, Col: col})
+		} else if strings.ContainsRune(operators, c) || (c == '?' && startsOperation(res, lineStart, str.Len())) {
+			flush()
+			res = append(res, Token{Typ: TokenTypeOperator, Str: string(c), Line: line, Col: col})
 		} else if c == '\n' {
-			if str.Len() > 0 {
-				res = append(res, Token{
-					Typ: TokenTypeString,
-					Str: str.String(),
-				})
-			}
-			str.Reset()
-			res = append(res, Token{Typ: TokenTypeNewLine, Str: ""})
-		} else if c == '(' {
-			if str.Len() > 0 {
-				res = append(res, Token{
-					Typ: TokenTypeString,
-					Str: str.String(),
-				})
+			if len(res) == lineStart && strings.TrimSpace(str.String()) == "" {
+				// Blank lines do not end a step.
 				str.Reset()
+			} else {
+				flush()
+				res = append(res, Token{Typ: TokenTypeNewLine, Str: "", Line: line, Col: col})
 			}
-			res = append(res, Token{Typ: TokenTypeLParen})
+			lineStart = len(res)
+			line++
+			col = 0
+		} else if c == '(' {
+			flush()
+			res = append(res, Token{Typ: TokenTypeLParen, Line: line, Col: col})
 		} else if c == ')' {
-			if str.Len() > 0 {
-				res = append(res, Token{
-					Typ: TokenTypeString,
-					Str: str.String(),
-				})
-				str.Reset()
-			}
-			res = append(res, Token{Typ: TokenTypeRParen})
+			flush()
+			res = append(res, Token{Typ: TokenTypeRParen, Line: line, Col: col})
 		} else {
+			if str.Len() == 0 {
+				strLine, strCol = line, col
+			}
 			str.WriteRune(c)
 		}
 	}
-	if str.Len() > 0 {
-		res = append(res, Token{
-			Typ: TokenTypeString,
-			Str: str.String(),
-		})
+	if len(res) == lineStart && strings.TrimSpace(str.String()) == "" {
+		str.Reset()
 	}
+	flush()
 	return res
 }
+
+// startsOperation returns true if the next character is the first of an
+// operation. Only there is ? the filter marker, elsewhere it is part of a
+// string, as in a URL with a query string.
+func startsOperation(res []Token, lineStart int, pending int) bool {
+	if pending > 0 {
+		return false
+	}
+	return len(res) == lineStart || res[len(res)-1].Typ == TokenTypeComma
+}
+
+func isSpace(c rune) bool {
+	return c == ' ' || c == '\t'
+}
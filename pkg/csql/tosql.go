@@ -0,0 +1,612 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ToSQL translates the query to an SQLite query on table, with each step as a
+// common table expression over the step before it. The columns of the table
+// are named by header, or c0, c1, ... if header is nil. An error is returned
+// for operations that cannot be written in SQL, such as tail().
+func (q *Query) ToSQL(table string, header []string) (string, error) {
+	t := &sqlTranslator{}
+	if header != nil {
+		t.named = true
+		for _, h := range header {
+			t.columns = append(t.columns, quoteIdentifier(h))
+		}
+	}
+	from := quoteIdentifier(table)
+	ctes := []string{}
+	var last *sqlSelect
+	// ordered is the number of the last step that ordered the rows, or 0 if
+	// the order no longer matters.
+	ordered := 0
+	for stepIdx := 0; stepIdx < len(q.steps); stepIdx++ {
+		ops := q.steps[stepIdx]
+		step, err := classifyStep(ops)
+		if err != nil {
+			return "", err
+		}
+		if step.letExpr != nil {
+			// The values of let steps are used where their parameters are.
+			continue
+		}
+		isGroup := step.groupOperations.groupExpr != nil || len(step.groupOperations.projectionExprs) > 0
+		if ordered != 0 && !isGroup {
+			// Rows are not ordered between common table expressions, so the
+			// order would be lost. Groups are not ordered by SQL anyway.
+			return "", fmt.Errorf("step %d: the order of step %d cannot be kept in SQL, since only the last step, or a limit right after it, can be ordered", stepIdx+1, ordered)
+		}
+		ordered = 0
+		if len(step.orderOperations) > 0 {
+			ordered = stepIdx + 1
+		}
+		var limit *LimitExpr
+		if len(step.orderOperations) > 0 && !step.hasRowLimit() && stepIdx+1 < len(q.steps) && isLimitStep(q.steps[stepIdx+1]) {
+			// Rows are not ordered between common table expressions, so a
+			// limit right after ordering is done in the same select.
+			limit = q.steps[stepIdx+1][0].(*LimitExpr)
+		}
+		sel, err := t.step(ops, step, from, limit)
+		if err != nil {
+			return "", fmt.Errorf("step %d: %w", stepIdx+1, err)
+		}
+		if last != nil {
+			ctes = append(ctes, fmt.Sprintf("%v AS (\n%v\n)", from, last.indent("  ")))
+		}
+		last = sel
+		from = "step" + strconv.Itoa(stepIdx+1)
+		if limit != nil {
+			stepIdx++
+		}
+	}
+	if last == nil {
+		last = &sqlSelect{columns: []string{"*"}, from: from}
+	}
+
+	sb := strings.Builder{}
+	if len(ctes) > 0 {
+		sb.WriteString("WITH ")
+		sb.WriteString(strings.Join(ctes, ", "))
+		sb.WriteString("\n")
+	}
+	sb.WriteString(last.String())
+	sb.WriteString(";\n")
+	return sb.String(), nil
+}
+
+type sqlSelect struct {
+	distinct bool
+	columns  []string
+	from     string
+	joins    []string
+	where    []string
+	groupBy  []string
+	orderBy  []string
+	limit    string
+}
+
+func (s *sqlSelect) String() string {
+	lines := []string{}
+	selectClause := "SELECT "
+	if s.distinct {
+		selectClause += "DISTINCT "
+	}
+	lines = append(lines, selectClause+strings.Join(s.columns, ", "))
+	lines = append(lines, "FROM "+s.from)
+	lines = append(lines, s.joins...)
+	if len(s.where) > 0 {
+		lines = append(lines, "WHERE "+strings.Join(s.where, " AND "))
+	}
+	if len(s.groupBy) > 0 {
+		lines = append(lines, "GROUP BY "+strings.Join(s.groupBy, ", "))
+	}
+	if len(s.orderBy) > 0 {
+		lines = append(lines, "ORDER BY "+strings.Join(s.orderBy, ", "))
+	}
+	if s.limit != "" {
+		lines = append(lines, s.limit)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s *sqlSelect) indent(prefix string) string {
+	return prefix + strings.ReplaceAll(s.String(), "\n", "\n"+prefix)
+}
+
+// sqlTranslator holds the columns of the result of the last translated step.
+type sqlTranslator struct {
+	// columns are the names of the columns, or nil if the number of columns
+	// is not known, in which case column $i is named ci.
+	columns []string
+	// named is true if the columns of the input are named by a header, in
+	// which case the names are kept for columns that are projected as is.
+	named bool
+	// joined is true after a join, since the columns of the joined file and
+	// so the names of the columns after it are not known.
+	joined bool
+}
+
+func (t *sqlTranslator) step(ops []Expression, step *stepOperations, from string, limit *LimitExpr) (*sqlSelect, error) {
+	sel := &sqlSelect{
+		columns: []string{"*"},
+		from:    from,
+	}
+	if step.pivotExpr != nil || step.unpivotExpr != nil {
+		return nil, fmt.Errorf("pivot and unpivot cannot be translated to SQL, since the columns of the result depend on the data")
+	}
+	if step.tailExpr != nil {
+		return nil, fmt.Errorf("tail cannot be translated to SQL, since SQL does not keep the order of rows")
+	}
+	if step.joinExpr != nil {
+		return sel, t.join(sel, step.joinExpr)
+	}
+
+	groupOperations := step.groupOperations
+	if groupOperations.groupExpr != nil || len(groupOperations.projectionExprs) > 0 {
+		outputs := []sqlOutput{}
+		if groupOperations.groupExpr != nil {
+			for _, key := range groupOperations.groupExpr.arguments.exprs {
+				keys, err := t.outputs(key)
+				if err != nil {
+					return nil, err
+				}
+				for _, k := range keys {
+					sel.groupBy = append(sel.groupBy, k.sql)
+				}
+				outputs = append(outputs, keys...)
+			}
+		}
+		for _, aggr := range groupOperations.projectionExprs {
+			sql, err := t.expr(aggr)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, sqlOutput{sql: sql, column: -1})
+		}
+		t.project(sel, outputs)
+		return sel, nil
+	}
+
+	if step.distinctExpr != nil {
+		if len(step.distinctExpr.arguments.exprs) > 0 {
+			return nil, fmt.Errorf("distinct with columns cannot be translated to SQL, only distinct() can")
+		}
+		sel.distinct = true
+	}
+	for _, order := range step.orderOperations {
+		sql, err := t.expr(order.argument)
+		if err != nil {
+			return nil, err
+		}
+		switch order.collation {
+		case CollationNoCase:
+			sql += " COLLATE NOCASE"
+		case CollationNatural:
+			return nil, fmt.Errorf("natural ordering cannot be translated to SQL")
+		}
+		if order.direction == OrderDirectionDesc {
+			sql += " DESC"
+		}
+		switch order.nulls {
+		case NullsFirst:
+			sql += " NULLS FIRST"
+		case NullsLast:
+			sql += " NULLS LAST"
+		}
+		sel.orderBy = append(sel.orderBy, sql)
+	}
+	if len(step.limitOperations) > 0 {
+		limit = step.limitOperations[0]
+	}
+	if limit != nil {
+		sel.limit = fmt.Sprintf("LIMIT %d", limit.limit)
+		if limit.offset != 0 {
+			sel.limit += fmt.Sprintf(" OFFSET %d", limit.offset)
+		}
+	}
+	if step.sampleExpr != nil {
+		if step.sampleExpr.seeded {
+			return nil, fmt.Errorf("sample with a seed cannot be translated to SQL")
+		}
+		if len(step.orderOperations) > 0 {
+			// The sample is picked by ordering randomly, which would replace
+			// the order of the step.
+			return nil, fmt.Errorf("sample in the same line as order cannot be translated to SQL")
+		}
+		sel.orderBy = []string{"RANDOM()"}
+		sel.limit = fmt.Sprintf("LIMIT %d", step.sampleExpr.n)
+	}
+	if step.distinctExpr != nil || len(step.orderOperations) > 0 || step.hasRowLimit() {
+		return sel, nil
+	}
+
+	outputs := []sqlOutput{}
+	for _, op := range ops {
+		if op.Type() == ExpressionNop {
+			continue
+		}
+		// Operations whose role depends on the type of their result, such as
+		// a column reference, are projected, since the types are not known.
+		if slotRole(op) == roleFilter {
+			sql, err := t.expr(op)
+			if err != nil {
+				return nil, err
+			}
+			sel.where = append(sel.where, sql)
+			continue
+		}
+		res, err := t.outputs(op)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, res...)
+	}
+	if len(outputs) > 0 {
+		t.project(sel, outputs)
+	}
+	return sel, nil
+}
+
+// sqlOutput is a column in the result of a step. column is the index of the
+// column if it is projected as is, or -1 if it is computed.
+type sqlOutput struct {
+	sql    string
+	column int
+}
+
+// outputs returns the columns that an operation projects, which is several
+// columns for a column range.
+func (t *sqlTranslator) outputs(e Expression) ([]sqlOutput, error) {
+	if k, ok := e.(*KeepExpr); ok {
+		e = k.inner
+	}
+	switch e := e.(type) {
+	case *ColumnReferenceExpression:
+		sql, err := t.expr(e)
+		return []sqlOutput{{sql: sql, column: e.index}}, err
+	case *ColumnRangeExpression:
+		if t.columns == nil {
+			if e.all && len(e.exclude) == 0 && !t.joined {
+				return []sqlOutput{{sql: "*", column: -1}}, nil
+			}
+			if e.all || e.from < 0 || e.to < 0 || len(e.exclude) > 0 {
+				return nil, fmt.Errorf("the column range %v can only be translated to SQL if the columns are named with a header", (&printer{}).expr(e))
+			}
+		}
+		width := len(t.columns)
+		if t.columns == nil {
+			width = e.to + 1
+		}
+		indexes, err := e.indexes(width)
+		if err != nil {
+			return nil, err
+		}
+		res := []sqlOutput{}
+		for _, idx := range indexes {
+			sql, err := t.column(idx)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, sqlOutput{sql: sql, column: idx})
+		}
+		return res, nil
+	}
+	sql, err := t.expr(e)
+	return []sqlOutput{{sql: sql, column: -1}}, err
+}
+
+// project sets the columns of a select and names the columns of its result.
+func (t *sqlTranslator) project(sel *sqlSelect, outputs []sqlOutput) {
+	if len(outputs) == 1 && outputs[0].sql == "*" {
+		return
+	}
+	sel.columns = []string{}
+	columns := []string{}
+	used := map[string]bool{}
+	for i, o := range outputs {
+		name := "c" + strconv.Itoa(i)
+		if t.named && o.column >= 0 && !used[o.sql] {
+			name = o.sql
+		}
+		for used[name] {
+			name += "_" + strconv.Itoa(i)
+		}
+		used[name] = true
+		columns = append(columns, name)
+		if name == o.sql {
+			sel.columns = append(sel.columns, o.sql)
+		} else {
+			sel.columns = append(sel.columns, o.sql+" AS "+name)
+		}
+	}
+	t.columns = columns
+	t.joined = false
+}
+
+func (t *sqlTranslator) join(sel *sqlSelect, j *JoinExpr) error {
+	left, err := t.expr(j.leftKey)
+	if err != nil {
+		return err
+	}
+	table := quoteIdentifier(j.source)
+	// The columns of the joined file are named c0, c1, ...
+	right, err := (&sqlTranslator{}).expr(j.rightKey)
+	if err != nil {
+		return err
+	}
+	// Both sides may have columns with the same names, so the keys are
+	// qualified with the names of their tables.
+	right = qualifyColumns(right, table)
+	left = qualifyColumns(left, sel.from)
+	switch j.joinType {
+	case JoinTypeInner:
+		sel.joins = append(sel.joins, fmt.Sprintf("JOIN %v ON %v = %v", table, left, right))
+	case JoinTypeLeft:
+		sel.joins = append(sel.joins, fmt.Sprintf("LEFT JOIN %v ON %v = %v", table, left, right))
+	case JoinTypeAnti:
+		sel.where = append(sel.where, fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %v WHERE %v = %v)", table, right, left))
+		return nil
+	}
+	sel.columns = []string{sel.from + ".*", table + ".*"}
+	t.columns = nil
+	t.joined = true
+	return nil
+}
+
+// qualifyColumns prefixes the column names ci in an SQL expression with a
+// table name.
+func qualifyColumns(sql string, table string) string {
+	sb := strings.Builder{}
+	for i := 0; i < len(sql); i++ {
+		if sql[i] == 'c' && (i == 0 || !isWordByte(sql[i-1])) && i+1 < len(sql) && sql[i+1] >= '0' && sql[i+1] <= '9' {
+			sb.WriteString(table + ".")
+		}
+		if sql[i] == '\'' {
+			// Skip string literals.
+			end := strings.IndexByte(sql[i+1:], '\'')
+			for end >= 0 && i+end+2 < len(sql) && sql[i+end+2] == '\'' {
+				next := strings.IndexByte(sql[i+end+3:], '\'')
+				if next < 0 {
+					end = -1
+					break
+				}
+				end += next + 2
+			}
+			if end >= 0 {
+				sb.WriteString(sql[i : i+end+2])
+				i += end + 1
+				continue
+			}
+		}
+		sb.WriteByte(sql[i])
+	}
+	return sb.String()
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (t *sqlTranslator) column(index int) (string, error) {
+	if t.joined {
+		return "", fmt.Errorf("columns after a join cannot be translated to SQL, since the columns of the joined file are not known")
+	}
+	if t.columns == nil {
+		if index < 0 {
+			return "", fmt.Errorf("column $%d can only be translated to SQL if the columns are named with a header", index)
+		}
+		return "c" + strconv.Itoa(index), nil
+	}
+	idx, ok := resolveColumn(index, len(t.columns))
+	if !ok {
+		return "", columnOutOfRange(index, len(t.columns))
+	}
+	return t.columns[idx], nil
+}
+
+func (t *sqlTranslator) expr(e Expression) (string, error) {
+	if lhs, op, rhs, ok := binaryOperands(e); ok {
+		l, err := t.operand(lhs)
+		if err != nil {
+			return "", err
+		}
+		r, err := t.operand(rhs)
+		if err != nil {
+			return "", err
+		}
+		if op == "/" {
+			// Dividing integers gives a double, as it does in queries.
+			l = "CAST(" + l + " AS REAL)"
+		}
+		return l + " " + op + " " + r, nil
+	}
+	switch e := e.(type) {
+	case *LiteralExpression:
+		return sqlLiteral(e.value), nil
+	case *ParameterExpression:
+		if e.value == nil {
+			return "", fmt.Errorf("parameter :%v is not defined", e.name)
+		}
+		return sqlLiteral(e.value.value), nil
+	case *ColumnReferenceExpression:
+		return t.column(e.index)
+	case *OpNeg:
+		inner, err := t.operand(e.inner)
+		if err != nil {
+			return "", err
+		}
+		return "NOT " + inner, nil
+	case *WhereExpr:
+		return t.expr(e.inner)
+	case *KeepExpr:
+		return t.expr(e.inner)
+	case *Funcall:
+		return t.funcall(e)
+	case *AggregatingExpr:
+		if e.aggregationName != "sum" {
+			return "", fmt.Errorf("aggregation %v cannot be translated to SQL", e.aggregationName)
+		}
+		arg, err := t.expr(e.argument)
+		if err != nil {
+			return "", err
+		}
+		return "SUM(" + arg + ")", nil
+	case *WindowExpr:
+		return t.window(e)
+	case *ColumnRangeExpression:
+		return "", fmt.Errorf("column ranges can only be translated to SQL when they are projected")
+	}
+	return "", fmt.Errorf("%v cannot be translated to SQL", (&printer{explicit: true}).expr(e))
+}
+
+// operand translates an operand of an operator, in parentheses if it is an
+// operation itself.
+func (t *sqlTranslator) operand(e Expression) (string, error) {
+	sql, err := t.expr(e)
+	if err != nil {
+		return "", err
+	}
+	if _, _, _, ok := binaryOperands(e); ok {
+		return "(" + sql + ")", nil
+	}
+	if _, ok := e.(*OpNeg); ok {
+		return "(" + sql + ")", nil
+	}
+	return sql, nil
+}
+
+func (t *sqlTranslator) funcall(f *Funcall) (string, error) {
+	args := make([]string, len(f.arguments.exprs))
+	for i, a := range f.arguments.exprs {
+		sql, err := t.expr(a)
+		if err != nil {
+			return "", err
+		}
+		args[i] = sql
+	}
+	switch f.funcName {
+	case "has":
+		return fmt.Sprintf("instr(%v, %v) > 0", args[0], args[1]), nil
+	case "if":
+		return fmt.Sprintf("CASE WHEN %v THEN %v ELSE %v END", args[0], args[1], args[2]), nil
+	case "case":
+		sb := strings.Builder{}
+		sb.WriteString("CASE")
+		for i := 0; i+1 < len(args); i += 2 {
+			sb.WriteString(fmt.Sprintf(" WHEN %v THEN %v", args[i], args[i+1]))
+		}
+		if len(args)%2 == 1 {
+			sb.WriteString(" ELSE " + args[len(args)-1])
+		}
+		sb.WriteString(" END")
+		return sb.String(), nil
+	case "int":
+		return "CAST(" + args[0] + " AS INTEGER)", nil
+	case "float":
+		return "CAST(" + args[0] + " AS REAL)", nil
+	case "str":
+		return "CAST(" + args[0] + " AS TEXT)", nil
+	case "date":
+		if len(args) == 1 {
+			return "datetime(" + args[0] + ")", nil
+		}
+		switch (&printer{}).expr(f.arguments.exprs[1]) {
+		case "epoch":
+			return "datetime(" + args[0] + ", 'unixepoch')", nil
+		case "epochms":
+			return "datetime(" + args[0] + " / 1000.0, 'unixepoch')", nil
+		}
+		return "", fmt.Errorf("date with a layout other than epoch or epochms cannot be translated to SQL")
+	}
+	return "", fmt.Errorf("function %v cannot be translated to SQL", f.funcName)
+}
+
+func (t *sqlTranslator) window(w *WindowExpr) (string, error) {
+	if w.funcName != "rank" {
+		return "", fmt.Errorf("%v cannot be translated to SQL, since it depends on the order of the rows, which SQL does not keep", w.funcName)
+	}
+	over := []string{}
+	if len(w.partition.exprs) > 0 {
+		partition := []string{}
+		for _, p := range w.partition.exprs {
+			sql, err := t.expr(p)
+			if err != nil {
+				return "", err
+			}
+			partition = append(partition, sql)
+		}
+		over = append(over, "PARTITION BY "+strings.Join(partition, ", "))
+	}
+	order, err := t.expr(w.order.argument)
+	if err != nil {
+		return "", err
+	}
+	if w.order.direction == OrderDirectionDesc {
+		order += " DESC"
+	}
+	over = append(over, "ORDER BY "+order)
+	return "RANK() OVER (" + strings.Join(over, " ") + ")", nil
+}
+
+func sqlLiteral(v Value) string {
+	if v.IsNull() {
+		return "NULL"
+	}
+	switch v.typ {
+	case ValueTypeString:
+		return "'" + strings.ReplaceAll(v.value.(string), "'", "''") + "'"
+	case ValueTypeBool:
+		if v.value.(bool) {
+			return "TRUE"
+		}
+		return "FALSE"
+	case ValueTypeDate:
+		t, _ := v.Time()
+		return "'" + t.Format("2006-01-02 15:04:05") + "'"
+	}
+	return v.String()
+}
+
+// quoteIdentifier quotes a name for use in SQL if it is not a plain
+// identifier.
+func quoteIdentifier(name string) string {
+	plain := name != ""
+	for i := 0; i < len(name); i++ {
+		if !isWordByte(name[i]) || (i == 0 && name[i] >= '0' && name[i] <= '9') {
+			plain = false
+		}
+	}
+	if plain && !sqlKeywords[strings.ToUpper(name)] {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqlKeywords are keywords that are likely to be used as column names, which
+// have to be quoted.
+var sqlKeywords = map[string]bool{
+	"AS": true, "BY": true, "CASE": true, "DATE": true, "DESC": true,
+	"FROM": true, "GROUP": true, "INDEX": true, "KEY": true, "LIMIT": true,
+	"ORDER": true, "SELECT": true, "TABLE": true, "TO": true, "VALUES": true,
+	"WHERE": true,
+}
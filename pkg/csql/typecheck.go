@@ -0,0 +1,364 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"fmt"
+	"io"
+)
+
+// typeCheck checks that the operations of a query are valid for the types of
+// the columns in its input. Columns with values of several types have the
+// type ValueTypeUnknown and are not checked. Checking stops at a step whose
+// output types cannot be known, such as a join.
+func typeCheck(operations [][]Expression, schema []ValueType) error {
+	for stepIdx, ops := range operations {
+		if schema == nil {
+			return nil
+		}
+		next, err := typeCheckStep(ops, schema)
+		if err != nil {
+			return fmt.Errorf("step %d: %w", stepIdx+1, err)
+		}
+		schema = next
+	}
+	return nil
+}
+
+// typeCheckStep checks the operations of a step and returns the types of the
+// columns in its output, or nil if they cannot be known.
+func typeCheckStep(ops []Expression, schema []ValueType) ([]ValueType, error) {
+	step, err := classifyStep(ops)
+	if err != nil {
+		return nil, err
+	}
+	if step.letExpr != nil {
+		return schema, nil
+	}
+	types := make([]ValueType, len(ops))
+	for i, op := range ops {
+		typ, err := inferType(op, schema)
+		if err != nil {
+			return nil, fmt.Errorf("%w in column %d", err, i)
+		}
+		types[i] = typ
+	}
+
+	if step.joinExpr != nil || step.pivotExpr != nil || step.unpivotExpr != nil {
+		return nil, nil
+	}
+	if step.groupOperations.groupExpr != nil || len(step.groupOperations.projectionExprs) > 0 {
+		res := []ValueType{}
+		if step.groupOperations.groupExpr != nil {
+			for _, e := range step.groupOperations.groupExpr.arguments.exprs {
+				res = appendTypes(res, e, schema)
+			}
+		}
+		// The sum of a group with a single row keeps the type of the row.
+		for range step.groupOperations.projectionExprs {
+			res = append(res, ValueTypeUnknown)
+		}
+		return res, nil
+	}
+	if len(step.orderOperations) > 0 || step.hasRowLimit() || step.distinctExpr != nil {
+		return schema, nil
+	}
+
+	res := []ValueType{}
+	for i, op := range ops {
+		if op.Type() == ExpressionNop {
+			// An empty operation neither filters nor projects.
+			continue
+		}
+		if op.Type() == ExpressionWindow {
+			res = append(res, types[i])
+			continue
+		}
+		if types[i] == ValueTypeUnknown && slotRole(op) == roleProjectionOrFilter {
+			// Whether this is a filter or a projection is only known when
+			// the query runs.
+			return nil, nil
+		}
+		if !isFilter(op, &Value{typ: types[i]}) {
+			res = appendTypes(res, op, schema)
+		}
+	}
+	if len(res) == 0 {
+		return schema, nil
+	}
+	return res, nil
+}
+
+// appendTypes appends the type of the result of an expression to types,
+// expanding column ranges into one type per column.
+func appendTypes(types []ValueType, e Expression, schema []ValueType) []ValueType {
+	if r, ok := e.(*ColumnRangeExpression); ok {
+		indexes, err := r.indexes(len(schema))
+		if err != nil {
+			return append(types, ValueTypeUnknown)
+		}
+		for _, idx := range indexes {
+			types = append(types, schema[idx])
+		}
+		return types
+	}
+	typ, err := inferType(e, schema)
+	if err != nil {
+		typ = ValueTypeUnknown
+	}
+	return append(types, typ)
+}
+
+// inferType returns the type of the result of an expression for a row with
+// columns of the given types, or ValueTypeUnknown if it cannot be known.
+func inferType(e Expression, schema []ValueType) (ValueType, error) {
+	switch e := e.(type) {
+	case *LiteralExpression:
+		return e.value.typ, nil
+	case *ParameterExpression:
+		if e.value == nil {
+			return ValueTypeUnknown, nil
+		}
+		return e.value.value.typ, nil
+	case *ColumnReferenceExpression:
+		idx, ok := e.resolve(len(schema))
+		if !ok {
+			return ValueTypeUnknown, fmt.Errorf("column $%d does not exist, the input has %d columns", e.index, len(schema))
+		}
+		return schema[idx], nil
+	case *ColumnRangeExpression:
+		if _, err := e.indexes(len(schema)); err != nil {
+			return ValueTypeUnknown, err
+		}
+		return ValueTypeList, nil
+	case *OpEquals:
+		return inferComparison(e.lhs, e.rhs, schema)
+	case *OpLt:
+		return inferComparison(e.lhs, e.rhs, schema)
+	case *OpGt:
+		return inferComparison(e.lhs, e.rhs, schema)
+	case *OpNeg:
+		typ, err := inferType(e.inner, schema)
+		if err != nil {
+			return ValueTypeUnknown, err
+		}
+		if typ != ValueTypeUnknown && typ != ValueTypeBool {
+			return ValueTypeUnknown, fmt.Errorf("cannot negate %v", typeName(typ))
+		}
+		return ValueTypeBool, nil
+	case *OpAdd:
+		return inferArithmetic("add", e.lhs, e.rhs, schema)
+	case *OpSub:
+		return inferArithmetic("subtract", e.lhs, e.rhs, schema)
+	case *OpMul:
+		return inferArithmetic("multiply", e.lhs, e.rhs, schema)
+	case *OpDiv:
+		return inferArithmetic("divide", e.lhs, e.rhs, schema)
+	case *Funcall:
+		return inferFuncall(e, schema)
+	case *WhereExpr:
+		typ, err := inferType(e.inner, schema)
+		if err != nil {
+			return ValueTypeUnknown, err
+		}
+		if typ != ValueTypeUnknown && typ != ValueTypeBool {
+			return ValueTypeUnknown, fmt.Errorf("filter must be a boolean, got %v", typeName(typ))
+		}
+		return ValueTypeBool, nil
+	case *KeepExpr:
+		return inferType(e.inner, schema)
+	case *GroupingExpr:
+		if err := inferArguments(e.arguments.exprs, schema); err != nil {
+			return ValueTypeUnknown, err
+		}
+		return ValueTypeList, nil
+	case *DistinctExpr:
+		if err := inferArguments(e.arguments.exprs, schema); err != nil {
+			return ValueTypeUnknown, err
+		}
+		return ValueTypeList, nil
+	case *AggregatingExpr:
+		typ, err := inferType(e.argument, schema)
+		if err != nil {
+			return ValueTypeUnknown, err
+		}
+		fn, _ := e.resolved()
+		numeric := fn.valueType == ValueTypeInt || fn.valueType == ValueTypeDouble
+		if numeric && !isNumericType(typ) {
+			return ValueTypeUnknown, fmt.Errorf("cannot %v %v", e.aggregationName, typeName(typ))
+		}
+		return ValueTypeUnknown, nil
+	case *OrderingExpr:
+		return inferType(e.argument, schema)
+	case *WindowExpr:
+		return inferWindow(e, schema)
+	case *JoinExpr:
+		_, err := inferType(e.leftKey, schema)
+		return ValueTypeUnknown, err
+	}
+	return ValueTypeUnknown, nil
+}
+
+func inferArguments(exprs []Expression, schema []ValueType) error {
+	for _, e := range exprs {
+		if _, err := inferType(e, schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isNumericType(typ ValueType) bool {
+	return typ == ValueTypeInt || typ == ValueTypeDouble || typ == ValueTypeUnknown
+}
+
+// inferComparison checks the operands of =, < and >. The right hand side is
+// converted to the type of the left hand side, which always works for strings.
+func inferComparison(lhs, rhs Expression, schema []ValueType) (ValueType, error) {
+	l, err := inferType(lhs, schema)
+	if err != nil {
+		return ValueTypeUnknown, err
+	}
+	r, err := inferType(rhs, schema)
+	if err != nil {
+		return ValueTypeUnknown, err
+	}
+	if l == r || l == ValueTypeUnknown || r == ValueTypeUnknown || l == ValueTypeString {
+		return ValueTypeBool, nil
+	}
+	if isNumericType(l) && isNumericType(r) {
+		return ValueTypeBool, nil
+	}
+	return ValueTypeUnknown, fmt.Errorf("cannot compare %v and %v", typeName(l), typeName(r))
+}
+
+func inferArithmetic(name string, lhs, rhs Expression, schema []ValueType) (ValueType, error) {
+	l, err := inferType(lhs, schema)
+	if err != nil {
+		return ValueTypeUnknown, err
+	}
+	r, err := inferType(rhs, schema)
+	if err != nil {
+		return ValueTypeUnknown, err
+	}
+	if !isNumericType(l) || !isNumericType(r) {
+		return ValueTypeUnknown, fmt.Errorf("cannot %v %v and %v", name, typeName(l), typeName(r))
+	}
+	return l, nil
+}
+
+func inferFuncall(f *Funcall, schema []ValueType) (ValueType, error) {
+	fn, ok := f.resolved()
+	if !ok {
+		return ValueTypeUnknown, fmt.Errorf("function '%v' not found", f.funcName)
+	}
+	args := make([]ValueType, len(f.arguments.exprs))
+	for i, e := range f.arguments.exprs {
+		typ, err := inferType(e, schema)
+		if err != nil {
+			return ValueTypeUnknown, err
+		}
+		args[i] = typ
+	}
+
+	switch f.funcName {
+	case "if", "case":
+		var res ValueType
+		for i, typ := range args {
+			isCondition := i%2 == 0 && (f.funcName == "case" && i+1 < len(args) || f.funcName == "if" && i == 0)
+			if isCondition {
+				if typ != ValueTypeUnknown && typ != ValueTypeBool {
+					return ValueTypeUnknown, fmt.Errorf("condition of %v must be a boolean, got %v", f.funcName, typeName(typ))
+				}
+				continue
+			}
+			if res == ValueTypeUnknown || res == typ {
+				res = typ
+			} else {
+				return ValueTypeUnknown, nil
+			}
+		}
+		return res, nil
+	}
+	if fn.returnType != ValueTypeUnknown && fn.returnType != ValueTypeBool && len(args) > 0 {
+		// Casts can fail for some values of a type, but never for others.
+		if !canConvert(args[0], fn.returnType) {
+			return ValueTypeUnknown, conversionError(args[0], fn.returnType)
+		}
+	}
+	return fn.returnType, nil
+}
+
+func inferWindow(w *WindowExpr, schema []ValueType) (ValueType, error) {
+	if err := inferArguments(w.partition.exprs, schema); err != nil {
+		return ValueTypeUnknown, err
+	}
+	var arg ValueType
+	if w.order != nil {
+		if _, err := inferType(w.order.argument, schema); err != nil {
+			return ValueTypeUnknown, err
+		}
+	} else if w.argument != nil {
+		var err error
+		if arg, err = inferType(w.argument, schema); err != nil {
+			return ValueTypeUnknown, err
+		}
+	}
+	switch w.funcName {
+	case "rownum", "rank":
+		return ValueTypeInt, nil
+	case "cumsum", "movavg":
+		if !isNumericType(arg) {
+			return ValueTypeUnknown, fmt.Errorf("cannot %v %v", w.funcName, typeName(arg))
+		}
+		return ValueTypeDouble, nil
+	}
+	return arg, nil
+}
+
+// sampleRows reads up to n rows from the input. The returned iterator returns
+// the sampled rows followed by the rest of the input.
+func sampleRows(input rowIterator, n int) ([][]Value, rowIterator, error) {
+	sample := [][]Value{}
+	for len(sample) < n {
+		row, err := input.Next()
+		if err == io.EOF {
+			return sample, &sliceIterator{rows: sample}, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		sample = append(sample, row)
+	}
+	return sample, &concatIterator{first: &sliceIterator{rows: sample}, rest: input}, nil
+}
+
+type concatIterator struct {
+	first rowIterator
+	rest  rowIterator
+}
+
+func (s *concatIterator) Next() ([]Value, error) {
+	if s.first != nil {
+		row, err := s.first.Next()
+		if err != io.EOF {
+			return row, err
+		}
+		s.first = nil
+	}
+	return s.rest.Next()
+}
@@ -14,15 +14,17 @@ func _() {
 	_ = x[ValueTypeInt-3]
 	_ = x[ValueTypeDouble-4]
 	_ = x[ValueTypeDate-5]
+	_ = x[ValueTypeList-6]
 }
 
-const _ValueType_name = "ValueTypeUnknownValueTypeStringValueTypeBoolValueTypeIntValueTypeDoubleValueTypeDate"
+const _ValueType_name = "ValueTypeUnknownValueTypeStringValueTypeBoolValueTypeIntValueTypeDoubleValueTypeDateValueTypeList"
 
-var _ValueType_index = [...]uint8{0, 16, 31, 44, 56, 71, 84}
+var _ValueType_index = [...]uint8{0, 16, 31, 44, 56, 71, 84, 97}
 
 func (i ValueType) String() string {
-	if i < 0 || i >= ValueType(len(_ValueType_index)-1) {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_ValueType_index)-1 {
 		return "ValueType(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _ValueType_name[_ValueType_index[i]:_ValueType_index[i+1]]
+	return _ValueType_name[_ValueType_index[idx]:_ValueType_index[idx+1]]
 }
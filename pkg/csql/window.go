@@ -0,0 +1,268 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package csql
+
+import (
+	"fmt"
+	"io"
+	"slices"
+)
+
+// windowStage evaluates a step containing window functions. The filters and
+// projections of the step are applied to each row first, and the window
+// functions are then evaluated over all the rows that passed the filters.
+type windowStage struct {
+	input  rowIterator
+	ops    []Expression
+	step   int
+	output *sliceIterator
+}
+
+func (s *windowStage) Next() ([]Value, error) {
+	if s.output == nil {
+		rows, err := s.evaluate()
+		if err != nil {
+			return nil, err
+		}
+		s.output = &sliceIterator{rows: rows}
+	}
+	return s.output.Next()
+}
+
+func (s *windowStage) evaluate() ([][]Value, error) {
+	records := [][]Value{}
+	// projections holds the value of each non-window operation for each row,
+	// or nil if the operation was a filter.
+	projections := [][]*Value{}
+	for read := 1; ; read++ {
+		record, err := s.input.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		projection, ok, err := s.filter(record)
+		if err != nil {
+			return nil, rowError(s.step, read, err)
+		}
+		if ok {
+			records = append(records, record)
+			projections = append(projections, projection)
+		}
+	}
+
+	windowValues := make([][]Value, len(s.ops))
+	for i, op := range s.ops {
+		if w, ok := op.(*WindowExpr); ok {
+			values, err := evaluateWindow(w, i, records)
+			if err != nil {
+				return nil, err
+			}
+			windowValues[i] = values
+		}
+	}
+
+	rows := make([][]Value, len(records))
+	for r := range records {
+		row := []Value{}
+		for i, op := range s.ops {
+			if op.Type() == ExpressionWindow {
+				row = append(row, windowValues[i][r])
+			} else if projections[r][i] != nil {
+				row = expandResult(row, op, projections[r][i])
+			}
+		}
+		rows[r] = row
+	}
+	return rows, nil
+}
+
+func (s *windowStage) filter(record []Value) ([]*Value, bool, error) {
+	projection := make([]*Value, len(s.ops))
+	for i, op := range s.ops {
+		if op.Type() == ExpressionWindow {
+			continue
+		}
+		res, err := op.Execute(i, record)
+		if err != nil {
+			return nil, false, err
+		}
+		if res.value == nil {
+			continue
+		}
+		if isFilter(op, res.value) {
+			if !res.value.value.(bool) {
+				return nil, false, nil
+			}
+		} else {
+			projection[i] = res.value
+		}
+	}
+	return projection, true, nil
+}
+
+// evaluateWindow returns the value of a window function for each row.
+func evaluateWindow(w *WindowExpr, i int, records [][]Value) ([]Value, error) {
+	partitions, err := partitionRows(w, i, records)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []Value
+	if w.argument != nil {
+		args = make([]Value, len(records))
+		for r, record := range records {
+			res, err := w.argument.Execute(i, record)
+			if err != nil {
+				return nil, err
+			}
+			if res.value != nil {
+				args[r] = *res.value
+			}
+		}
+	}
+
+	res := make([]Value, len(records))
+	for _, rows := range partitions {
+		switch w.funcName {
+		case "rownum":
+			for k, r := range rows {
+				res[r] = Value{typ: ValueTypeInt, value: int64(k + 1)}
+			}
+		case "rank":
+			if err := rankRows(w.order, i, records, rows, res); err != nil {
+				return nil, err
+			}
+		case "cumsum":
+			sum := 0.0
+			seen := false
+			for _, r := range rows {
+				if !args[r].IsNull() {
+					v, err := args[r].Convert(ValueTypeDouble)
+					if err != nil {
+						return nil, fmt.Errorf("cumsum: %w", err)
+					}
+					sum += v.value.(float64)
+					seen = true
+				}
+				if seen {
+					res[r] = Value{typ: ValueTypeDouble, value: sum}
+				}
+			}
+		case "lag", "lead":
+			offset := int(w.n)
+			if w.funcName == "lag" {
+				offset = -offset
+			}
+			for k, r := range rows {
+				if k+offset >= 0 && k+offset < len(rows) {
+					res[r] = args[rows[k+offset]]
+				}
+			}
+		case "movavg":
+			for k, r := range rows {
+				sum := 0.0
+				count := 0
+				for _, prev := range rows[max(k-int(w.n)+1, 0) : k+1] {
+					if args[prev].IsNull() {
+						continue
+					}
+					v, err := args[prev].Convert(ValueTypeDouble)
+					if err != nil {
+						return nil, fmt.Errorf("movavg: %w", err)
+					}
+					sum += v.value.(float64)
+					count++
+				}
+				if count > 0 {
+					res[r] = Value{typ: ValueTypeDouble, value: sum / float64(count)}
+				}
+			}
+		default:
+			return nil, fmt.Errorf("window function '%v' not found", w.funcName)
+		}
+	}
+	return res, nil
+}
+
+// partitionRows splits the indexes of the rows by the partition key of a
+// window function. The partitions are returned in the order they were first
+// seen and the rows of each partition are in input order.
+func partitionRows(w *WindowExpr, i int, records [][]Value) ([][]int, error) {
+	if len(w.partition.exprs) == 0 {
+		rows := make([]int, len(records))
+		for r := range rows {
+			rows[r] = r
+		}
+		return [][]int{rows}, nil
+	}
+	partitions := [][]int{}
+	partitionIdx := map[string]int{}
+	for r, record := range records {
+		key := make([]Value, 0, len(w.partition.exprs))
+		for _, e := range w.partition.exprs {
+			res, err := e.Execute(i, record)
+			if err != nil {
+				return nil, err
+			}
+			if res.value != nil {
+				key = append(key, *res.value)
+			}
+		}
+		k := rowKey(key)
+		idx, ok := partitionIdx[k]
+		if !ok {
+			idx = len(partitions)
+			partitionIdx[k] = idx
+			partitions = append(partitions, nil)
+		}
+		partitions[idx] = append(partitions[idx], r)
+	}
+	return partitions, nil
+}
+
+// rankRows sets the rank of each row in a partition. Rows with equal values
+// get the same rank, and the next rank after a tie skips ahead by the number
+// of tied rows.
+func rankRows(order *OrderingExpr, i int, records [][]Value, rows []int, res []Value) error {
+	orderOperations := []*OrderingExpr{order}
+	keys := make(map[int][]Value, len(rows))
+	for _, r := range rows {
+		key, err := order.Execute(i, records[r])
+		if err != nil {
+			return err
+		}
+		if key.value != nil {
+			keys[r] = []Value{*key.value}
+		} else {
+			keys[r] = []Value{{}}
+		}
+	}
+	sorted := slices.Clone(rows)
+	slices.SortStableFunc(sorted, func(a, b int) int {
+		return compareKeys(orderOperations, keys[a], keys[b])
+	})
+	rank := 1
+	for k, r := range sorted {
+		if k > 0 && compareKeys(orderOperations, keys[sorted[k-1]], keys[r]) != 0 {
+			rank = k + 1
+		}
+		res[r] = Value{typ: ValueTypeInt, value: int64(rank)}
+	}
+	return nil
+}
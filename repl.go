@@ -0,0 +1,411 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackbister/csql/pkg/csql"
+	"golang.org/x/term"
+)
+
+const replHelp = `Enter a query to run it on the file. Steps can be continued on the next line with \.
+Commands:
+  :schema      Show the columns of the input and their types
+  :ops [query] Show the operations of a query, or of the last query
+  :sep <STR>   Change the separator of the file
+  :pipe        Run the following queries on the result of the last query
+  :file        Run the following queries on the file again
+  :help        Show this help
+  :quit        Exit
+`
+
+// repl is an interactive session, started with -i, which reads the input
+// file once and runs queries on it.
+type repl struct {
+	out     io.Writer
+	data    []byte
+	options csql.Options
+	// header holds the names of the columns if the first row of the file is
+	// skipped.
+	header []string
+	// functions are the names that queries can call, used for completion.
+	functions []string
+
+	lastQuery string
+	// lastResult is the result of the last query as CSV, separated by
+	// commas, which is used as the input when piping.
+	lastResult []byte
+	piping     bool
+
+	// cooked takes the terminal out of raw mode while a query runs, so that
+	// Ctrl-C interrupts it, and returns a function that puts it back. It is
+	// nil without a terminal.
+	cooked func() func()
+}
+
+func runREPL(path string, options csql.Options) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// Operations are shown with :ops instead.
+	options.PrintOps = false
+	r := &repl{
+		data:      data,
+		options:   options,
+		functions: csql.NewEngine().FunctionNames(),
+	}
+	r.readHeader()
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		// Without a terminal, such as when queries are piped to csql, there
+		// is no line editing and no prompt.
+		r.out = os.Stdout
+		scanner := bufio.NewScanner(os.Stdin)
+		return r.loop(func() (string, error) {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return "", err
+				}
+				return "", io.EOF
+			}
+			return scanner.Text(), nil
+		}, func(string) {})
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+	r.cooked = func() func() {
+		term.Restore(fd, state)
+		return func() {
+			if _, err := term.MakeRaw(fd); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "csql> ")
+	terminal.AutoCompleteCallback = r.complete
+	r.out = terminal
+	fmt.Fprintf(r.out, "Loaded %v. Type :help for help.\n", path)
+	return r.loop(terminal.ReadLine, terminal.SetPrompt)
+}
+
+// loop reads and runs commands until the input ends or :quit is entered.
+func (r *repl) loop(readLine func() (string, error), setPrompt func(string)) error {
+	for {
+		if r.piping {
+			setPrompt("csql| ")
+		} else {
+			setPrompt("csql> ")
+		}
+		line, err := readLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for strings.HasSuffix(line, "\\") {
+			setPrompt("  ... ")
+			next, err := readLine()
+			if err != nil {
+				break
+			}
+			line += "\n" + next
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			if quit := r.command(line); quit {
+				return nil
+			}
+			continue
+		}
+		r.run(line)
+	}
+}
+
+// command runs a meta-command and returns true if the session should end.
+func (r *repl) command(line string) bool {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case ":quit", ":q", ":exit":
+		return true
+	case ":help":
+		fmt.Fprint(r.out, replHelp)
+	case ":schema":
+		r.printSchema()
+	case ":ops":
+		if arg == "" {
+			arg = r.lastQuery
+		}
+		query, err := csql.Compile(arg, csql.WithOptions(r.options))
+		if err != nil {
+			r.printError(arg, err)
+			return false
+		}
+		query.WriteOps(r.out)
+	case ":sep":
+		if utf8.RuneCountInString(arg) != 1 {
+			fmt.Fprintln(r.out, "expected a single character separator, for example :sep ;")
+			return false
+		}
+		r.options.Separator = arg
+		r.readHeader()
+	case ":pipe":
+		if r.lastResult == nil {
+			fmt.Fprintln(r.out, "there is no result to pipe, run a query first")
+			return false
+		}
+		r.piping = true
+	case ":file":
+		r.piping = false
+	default:
+		fmt.Fprintf(r.out, "unknown command %v, type :help for help\n", name)
+	}
+	return false
+}
+
+// input returns the input of the next query and the options to read it with.
+func (r *repl) input() (io.Reader, csql.Options) {
+	if r.piping {
+		options := r.options
+		options.Separator = ","
+		options.Skip = 0
+		return bytes.NewReader(r.lastResult), options
+	}
+	return bytes.NewReader(r.data), r.options
+}
+
+func (r *repl) run(queryString string) {
+	input, options := r.input()
+	query, err := csql.Compile(queryString, csql.WithOptions(options))
+	if err != nil {
+		r.printError(queryString, err)
+		return
+	}
+	// Ctrl-C stops the query instead of ending the session.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if r.cooked != nil {
+		defer r.cooked()()
+	}
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	result := &bytes.Buffer{}
+	sink := &teeSink{
+		sinks: []csql.ResultSink{newSink(r.out), csql.NewCSVSink(result, ",", false)},
+	}
+	if err := query.Run(ctx, input, sink); err != nil {
+		if errors.Is(err, context.Canceled) {
+			err = errors.New("interrupted")
+		}
+		r.printError(queryString, err)
+		return
+	}
+	r.lastQuery = queryString
+	r.lastResult = result.Bytes()
+}
+
+func (r *repl) printError(query string, err error) {
+	var diagnostic *csql.Diagnostic
+	if errors.As(err, &diagnostic) {
+		fmt.Fprintln(r.out, diagnostic.Highlight(query))
+		return
+	}
+	fmt.Fprintln(r.out, err)
+}
+
+func (r *repl) printSchema() {
+	input, options := r.input()
+	query, err := csql.Compile("=", csql.WithOptions(options))
+	if err != nil {
+		r.printError("=", err)
+		return
+	}
+	sink := &schemaSink{}
+	if err := query.Run(context.Background(), input, sink); err != nil {
+		r.printError("=", err)
+		return
+	}
+	for i, c := range sink.schema {
+		name := ""
+		if !r.piping && i < len(r.header) {
+			name = r.header[i]
+		}
+		typ := strings.ToLower(strings.TrimPrefix(c.Type.String(), "ValueType"))
+		fmt.Fprintf(r.out, "%v\t%v\t%v\n", c.Name, typ, name)
+	}
+	fmt.Fprintf(r.out, "%d rows\n", sink.rows)
+}
+
+// readHeader reads the names of the columns from the first row of the file,
+// if it is skipped.
+func (r *repl) readHeader() {
+	r.header = nil
+	if r.options.Skip == 0 {
+		return
+	}
+	reader := csv.NewReader(bytes.NewReader(r.data))
+	reader.Comma, _ = utf8.DecodeRuneInString(r.options.Separator)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == nil {
+		r.header = header
+	}
+}
+
+// complete completes the word before the cursor when tab is pressed. Words
+// starting with $ are completed from the column headers to a column
+// reference, and other words are completed to function names.
+func (r *repl) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	start := pos
+	for start > 0 && isWordByte(line[start-1]) {
+		start--
+	}
+	if start > 0 && line[start-1] == '$' {
+		start--
+	}
+	word := line[start:pos]
+	if word == "" {
+		return "", 0, false
+	}
+
+	var completion string
+	if strings.HasPrefix(word, "$") {
+		prefix := strings.ToLower(word[1:])
+		matches := []string{}
+		for i, h := range r.header {
+			if strings.HasPrefix(strings.ToLower(h), prefix) {
+				matches = append(matches, "$"+strconv.Itoa(i))
+			}
+		}
+		if len(matches) != 1 {
+			return "", 0, false
+		}
+		completion = matches[0]
+	} else {
+		matches := []string{}
+		for _, f := range r.functions {
+			if strings.HasPrefix(f, word) {
+				matches = append(matches, f)
+			}
+		}
+		if len(matches) == 0 {
+			return "", 0, false
+		}
+		completion = commonPrefix(matches)
+		if len(matches) == 1 {
+			completion += "("
+		}
+	}
+	return line[:start] + completion + line[pos:], start + len(completion), true
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// teeSink writes a result to several sinks.
+type teeSink struct {
+	sinks []csql.ResultSink
+}
+
+func (t *teeSink) Begin(schema []csql.Column) error {
+	for _, s := range t.sinks {
+		if err := s.Begin(schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *teeSink) WriteRow(row []csql.Value) error {
+	for _, s := range t.sinks {
+		if err := s.WriteRow(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *teeSink) End() error {
+	for _, s := range t.sinks {
+		if err := s.End(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaSink records the schema of a result and counts its rows.
+type schemaSink struct {
+	schema []csql.Column
+	rows   int
+}
+
+func (s *schemaSink) Begin(schema []csql.Column) error {
+	s.schema = schema
+	return nil
+}
+
+func (s *schemaSink) WriteRow(row []csql.Value) error {
+	s.rows++
+	return nil
+}
+
+func (s *schemaSink) End() error {
+	return nil
+}
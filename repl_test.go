@@ -0,0 +1,135 @@
+// CSQL - A command-line tool for CSV querying
+// Copyright (C) 2025  Jack Bister
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jackbister/csql/pkg/csql"
+)
+
+const replTestCsv = "ticker,price\nAAPL,100\nXOM,5\nAAPL,110\n"
+
+func newTestREPL(out io.Writer) *repl {
+	options := csql.NewOptions()
+	options.Skip = 1
+	r := &repl{
+		out:       out,
+		data:      []byte(replTestCsv),
+		options:   options,
+		functions: csql.NewEngine().FunctionNames(),
+	}
+	r.readHeader()
+	return r
+}
+
+// runScript runs lines in a session and returns its output and the prompts
+// that were shown.
+func runScript(t *testing.T, lines ...string) (string, []string) {
+	t.Helper()
+	out := &strings.Builder{}
+	r := newTestREPL(out)
+	prompts := []string{}
+	err := r.loop(func() (string, error) {
+		if len(lines) == 0 {
+			return "", io.EOF
+		}
+		line := lines[0]
+		lines = lines[1:]
+		return line, nil
+	}, func(prompt string) {
+		prompts = append(prompts, prompt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), prompts
+}
+
+func TestREPLQuery(t *testing.T) {
+	out, _ := runScript(t, "=AAPL,$1")
+	if out != "100\n110\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestREPLContinuation(t *testing.T) {
+	out, prompts := runScript(t, "=AAPL,\\", "  $1")
+	if out != "100\n110\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	if prompts[1] != "  ... " {
+		t.Fatalf("expected a continuation prompt, got %v", prompts)
+	}
+}
+
+func TestREPLPipe(t *testing.T) {
+	out, prompts := runScript(t, ":pipe", "=AAPL,$1", ":pipe", "sum($0)", ":file", "sum($1)")
+	expected := "there is no result to pipe, run a query first\n100\n110\n210\n215\n"
+	if out != expected {
+		t.Fatalf("expected %q, got %q", expected, out)
+	}
+	if prompts[3] != "csql| " || prompts[5] != "csql> " {
+		t.Fatalf("expected the prompt to show piping, got %v", prompts)
+	}
+}
+
+func TestREPLCommands(t *testing.T) {
+	out, _ := runScript(t, ":schema", ":ops =AAPL", ":sep ab", ":nope", ":quit", "=AAPL")
+	for _, expected := range []string{
+		"$0\tstring\tticker\n$1\tint\tprice\n3 rows\n",
+		"step 1:",
+		"expected a single character separator",
+		"unknown command :nope",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("expected %q in the output, got %q", expected, out)
+		}
+	}
+	if strings.Contains(out, "100") {
+		t.Fatalf("expected no queries to run after :quit, got %q", out)
+	}
+}
+
+func TestREPLError(t *testing.T) {
+	out, _ := runScript(t, "summ($1)", "sum($1)")
+	if !strings.Contains(out, "did you mean sum?") || !strings.HasSuffix(out, "215\n") {
+		t.Fatalf("expected an error and the session to continue, got %q", out)
+	}
+}
+
+func TestREPLComplete(t *testing.T) {
+	r := newTestREPL(io.Discard)
+	tests := []struct {
+		line     string
+		expected string
+		ok       bool
+	}{
+		{"=AAPL,$pr", "=AAPL,$1", true},
+		{"=AAPL,$x", "", false},
+		{"=AAPL,cums", "=AAPL,cumsum(", true},
+		{"=AAPL,xyz", "", false},
+	}
+	for _, test := range tests {
+		line, pos, ok := r.complete(test.line, len(test.line), '\t')
+		if ok != test.ok || line != test.expected || (ok && pos != len(line)) {
+			t.Fatalf("expected %q to complete to %q, got %q at %d", test.line, test.expected, line, pos)
+		}
+	}
+}